@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// entryList is a modelSink that keeps the entries of a model in file order,
+// merging the entries of a prefix that appears more than once. Unlike a
+// Chain it keeps the order of the suffixes of every prefix, which decides
+// the words generation draws with a given seed.
+type entryList struct {
+	h  modelHeader
+	es []modelEntry
+	at map[string]int // index in es of every prefix key
+}
+
+func (l *entryList) begin(h modelHeader) {
+	*l = entryList{h: h, at: make(map[string]int)}
+}
+
+func (l *entryList) add(e modelEntry) {
+	key := e.Prefix.String()
+	if i, ok := l.at[key]; ok {
+		l.es[i].Suffixes = append(l.es[i].Suffixes, e.Suffixes...)
+		return
+	}
+	l.at[key] = len(l.es)
+	l.es = append(l.es, e)
+}
+
+// runConvert writes a model in another format:
+// mark convert [--format=index] modelfile outfilename
+// It holds the whole model in memory, whatever the formats.
+func runConvert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	format := flags.String("format", formatIndex,
+		"model file format: text, json, gob or index")
+	canonical := flags.Bool("canonical", false,
+		"write prefixes and suffixes in sorted order")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 2 {
+		return usageError("convert command should be: mark convert" +
+			" [--format=text|json|gob|index] [-canonical] modelfile outfilename")
+	}
+	if !validFormat(*format) {
+		return usageError("format should be text, json, gob or index")
+	}
+
+	in, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var l entryList
+	if _, err := decodeModel(in, &l); err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	if *canonical {
+		sortEntries(l.es)
+	}
+
+	return writeModelFile(args[1], func(w io.Writer) error {
+		return encodeEntries(w, l.h, l.es, *format)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// display returns the words of p separated by spaces, writing the empty
+// word as "" the way the text model format does and escaping white space
+// inside words.
+func (p Prefix) display() string {
+	words := make([]string, len(p))
+	for i, word := range p {
+		if word == "" {
+			word = "\"\""
+		}
+		words[i] = escapeWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+// sortedKeys returns the prefixes of c in canonical order.
+func (c *Chain) sortedKeys() []Prefix {
+	ps := make([]Prefix, 0, len(c.chain))
+	for key := range c.chain {
+		ps = append(ps, splitKey(key))
+	}
+	sort.Slice(ps, func(i, j int) bool { return comparePrefix(ps[i], ps[j]) < 0 })
+	return ps
+}
+
+// total returns the number of observations of a prefix.
+func total(tf map[string]int) int {
+	n := 0
+	for _, count := range tf {
+		n += count
+	}
+	return n
+}
+
+// Diff writes to stdout the differences from model a to model b: prefixes
+// only in b ("+"), prefixes only in a ("-") and, for prefixes in both,
+// suffixes whose count changed by at least threshold ("~"). It returns the
+// number of differences reported.
+func Diff(a, b *Chain, threshold int) int {
+	if a.prefixLen != b.prefixLen {
+		fmt.Printf("prefix length %d -> %d\n", a.prefixLen, b.prefixLen)
+	}
+
+	// Walk the union of the prefixes in canonical order.
+	keys := a.sortedKeys()
+	for _, p := range b.sortedKeys() {
+		if _, ok := a.chain[p.String()]; !ok {
+			keys = append(keys, p)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return comparePrefix(keys[i], keys[j]) < 0 })
+
+	var added, removed, changed int
+	for _, p := range keys {
+		atf, inA := a.chain[p.String()]
+		btf, inB := b.chain[p.String()]
+		switch {
+		case !inA:
+			fmt.Printf("+ %s (%d)\n", p.display(), total(btf))
+			added++
+		case !inB:
+			fmt.Printf("- %s (%d)\n", p.display(), total(atf))
+			removed++
+		default:
+			words := make([]string, 0, len(atf))
+			for word := range atf {
+				words = append(words, word)
+			}
+			for word := range btf {
+				if _, ok := atf[word]; !ok {
+					words = append(words, word)
+				}
+			}
+			sort.Strings(words)
+			for _, word := range words {
+				delta := btf[word] - atf[word]
+				if delta != 0 && (delta >= threshold || -delta >= threshold) {
+					fmt.Printf("~ %s -> %s: %d -> %d (%+d)\n",
+						p.display(), word, atf[word], btf[word], delta)
+					changed++
+				}
+			}
+		}
+	}
+	fmt.Printf("%d prefixes added, %d removed, %d suffix counts changed\n",
+		added, removed, changed)
+	return added + removed + changed
+}
+
+// runDiff compares two models: mark diff a.model b.model
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	threshold := flags.Int("threshold", 1,
+		"smallest suffix count change to report")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 2 {
+		return usageError("diff command should be: mark diff" +
+			" [-threshold n] modelfile1 modelfile2")
+	}
+
+	a, _, err := ReadChainFile(args[0])
+	if err != nil {
+		return err
+	}
+	b, _, err := ReadChainFile(args[1])
+	if err != nil {
+		return err
+	}
+	Diff(a, b, *threshold)
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Smoothing selects how Evaluate gives probability to suffixes a prefix
+// was never seen with.
+//
+// With add-k smoothing K is added to the count of every word of the
+// vocabulary, plus one slot for unknown words, after every prefix. K must
+// be above 0.
+//
+// Backoff smoothing needs a backoff model. It subtracts Discount from every
+// count and gives the freed probability to the estimate of the prefix one
+// word shorter, down to the shortest order, which is interpolated with
+// add-k smoothed word frequencies. Discount must be at least 0 and below 1.
+type Smoothing struct {
+	Backoff  bool
+	K        float64
+	Discount float64
+}
+
+// EvalResult tells how well a model predicts held-out text.
+type EvalResult struct {
+	Tokens       int
+	CrossEntropy float64 // bits per token
+	Perplexity   float64
+	OOVRate      float64 // fraction of tokens never seen in the model
+	UnseenRate   float64 // fraction of tokens whose prefix was never seen
+}
+
+// evaluator scores tokens against the counts of a Chain.
+type evaluator struct {
+	c       *Chain
+	sm      Smoothing
+	totals  map[string]int // observations of every prefix
+	unigram map[string]int // occurrences of every word as a suffix
+	n       int            // total of unigram
+	vocab   float64        // distinct words, plus one for unknown words
+
+	tokens, oov, unseen int
+	bits                float64 // sum of -log2 P over all tokens
+}
+
+func newEvaluator(c *Chain, sm Smoothing) *evaluator {
+	e := &evaluator{c: c, sm: sm, totals: make(map[string]int), unigram: make(map[string]int)}
+	for key, tf := range c.chain {
+		e.totals[key] = total(tf)
+		// Every token is counted once at each order, so the shortest
+		// prefixes alone give the word frequencies.
+		if len(splitKey(key)) != c.minOrder {
+			continue
+		}
+		for word, count := range tf {
+			e.unigram[word] += count
+			e.n += count
+		}
+	}
+	e.vocab = float64(len(e.unigram) + 1)
+	return e
+}
+
+// prob returns the smoothed probability of s following p.
+func (e *evaluator) prob(p Prefix, s string) float64 {
+	if !e.sm.Backoff {
+		key := p.String()
+		return (float64(e.c.chain[key][s]) + e.sm.K) / (float64(e.totals[key]) + e.sm.K*e.vocab)
+	}
+	pr := (float64(e.unigram[s]) + e.sm.K) / (float64(e.n) + e.sm.K*e.vocab)
+	for k := e.c.minOrder; k <= e.c.prefixLen; k++ {
+		key := p[len(p)-k:].String()
+		t := e.totals[key]
+		if t == 0 {
+			continue
+		}
+		tf := e.c.chain[key]
+		d := e.sm.Discount
+		pr = math.Max(float64(tf[s])-d, 0)/float64(t) + d*float64(len(tf))/float64(t)*pr
+	}
+	return pr
+}
+
+// read scores every token read from r, starting from the empty prefix and
+// tokenizing the way Chain.Read does.
+func (e *evaluator) read(r io.Reader) error {
+	p := make(Prefix, e.c.prefixLen)
+	return tokenizers[e.c.tokenizer].Tokenize(bufio.NewReader(r), func(s string) {
+		if s == sentenceStart {
+			for i := range p {
+				p[i] = ""
+			}
+		}
+		e.tokens++
+		if _, ok := e.unigram[s]; !ok {
+			e.oov++
+		}
+		if _, ok := e.totals[p.String()]; !ok {
+			e.unseen++
+		}
+		e.bits -= math.Log2(e.prob(p, s))
+		p.Shift(s)
+	})
+}
+
+func (e *evaluator) result() EvalResult {
+	res := EvalResult{Tokens: e.tokens}
+	if e.tokens > 0 {
+		n := float64(e.tokens)
+		res.CrossEntropy = e.bits / n
+		res.Perplexity = math.Exp2(res.CrossEntropy)
+		res.OOVRate = float64(e.oov) / n
+		res.UnseenRate = float64(e.unseen) / n
+	}
+	return res
+}
+
+// Evaluate scores the held-out text read from inputs against the counts of
+// c with the given smoothing. Each input starts from the empty prefix.
+func (c *Chain) Evaluate(sm Smoothing, inputs ...io.Reader) (EvalResult, error) {
+	if sm.Backoff && c.minOrder == c.prefixLen {
+		return EvalResult{}, fmt.Errorf("backoff smoothing needs a model read with --max-order")
+	}
+	if sm.K <= 0 {
+		return EvalResult{}, fmt.Errorf("smoothing needs K > 0")
+	}
+	if sm.Backoff && (sm.Discount < 0 || sm.Discount >= 1) {
+		return EvalResult{}, fmt.Errorf("backoff smoothing needs 0 <= Discount < 1")
+	}
+	e := newEvaluator(c, sm)
+	for _, r := range inputs {
+		if err := e.read(r); err != nil {
+			return EvalResult{}, err
+		}
+	}
+	return e.result(), nil
+}
+
+// runEval reports how well a model predicts held-out text:
+// mark eval modelfile heldout...
+func runEval(args []string) error {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	smoothing := flags.String("smoothing", "",
+		"add-k, or backoff (default: backoff for backoff models, else add-k)")
+	k := flags.Float64("k", 1, "count added to every word by add-k smoothing")
+	discount := flags.Float64("discount", 0.75,
+		"count subtracted from every word by backoff smoothing")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) < 2 {
+		return usageError("eval command should be: mark eval" +
+			" [-smoothing add-k|backoff] [-k k] [-discount d] modelfile heldout1 heldout2 ....")
+	}
+
+	c, _, err := ReadChainFile(args[0])
+	if err != nil {
+		return err
+	}
+	sm := Smoothing{K: *k, Discount: *discount}
+	switch *smoothing {
+	case "":
+		sm.Backoff = c.minOrder < c.prefixLen
+	case "add-k":
+	case "backoff":
+		sm.Backoff = true
+	default:
+		return usageError("smoothing should be add-k or backoff")
+	}
+	// Backoff smoothing adds k at its shortest order.
+	if !(*k > 0) {
+		return usageError("-k should be > 0")
+	}
+	if sm.Backoff && !(*discount >= 0 && *discount < 1) {
+		return usageError("-discount should be >= 0 and < 1")
+	}
+
+	var inputs []io.Reader
+	for _, heldout := range args[1:] {
+		f, err := openInput(heldout)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		inputs = append(inputs, f)
+	}
+	res, err := c.Evaluate(sm, inputs...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("tokens:          %d\n", res.Tokens)
+	fmt.Printf("cross-entropy:   %.4f bits/token\n", res.CrossEntropy)
+	fmt.Printf("perplexity:      %.2f\n", res.Perplexity)
+	fmt.Printf("out-of-vocab:    %.2f%%\n", 100*res.OOVRate)
+	fmt.Printf("unseen prefixes: %.2f%%\n", 100*res.UnseenRate)
+	return nil
+}
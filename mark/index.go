@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+)
+
+// An index model is a binary model file that generation can memory-map and
+// query in place, so that it starts at once and keeps in memory only the
+// pages it touches, however large the model. All integers are little
+// endian:
+//
+//	magic     "MARKIDX\n"
+//	hlen      uint32, then hlen bytes of modelHeader as JSON
+//	counts    uint64 prefixes, suffixes, words, and blob length
+//	prefixes  per prefix, sorted by key: key offset uint64 and length
+//	          uint32 in the blob, index of its first suffix uint64 and
+//	          number of suffixes uint32
+//	suffixes  per suffix: word number uint32, and cumulative count uint64
+//	          over the suffixes of its prefix, as in suffixes.cum
+//	words     per distinct word: offset uint64 and length uint32 in the blob
+//	blob      the prefix keys, as made by Prefix.String, then the words
+//
+// A prefix is found by binary search over the sorted keys, and a suffix
+// drawn by binary search over the cumulative counts of its prefix, so
+// generation decodes only the words it draws.
+//
+// Only generation works in place. Writing an index model, like the other
+// commands, reads the whole source model into memory first, so mark
+// convert needs about as much memory as the model it converts; the
+// index can then be used on machines with less.
+//
+// Because generation maps the file, an index model must never be rewritten
+// in place: truncating a mapped file makes its readers fault (SIGBUS). The
+// commands that write models write a new file and rename it over the old
+// one, see writeModelFile, and so must anything else that replaces one.
+const indexMagic = "MARKIDX\n"
+
+// Sizes of the records of an index model.
+const (
+	prefixRecord = 24
+	suffixRecord = 12
+	wordRecord   = 12
+)
+
+// maxInt is the largest int, for counts read from an index model.
+const maxInt = int(^uint(0) >> 1)
+
+var le = binary.LittleEndian
+
+// encodeIndex writes es as an index model. The suffixes of every prefix
+// keep their order, so that generation draws the same words as from the
+// model es was read from.
+func encodeIndex(w io.Writer, h modelHeader, es []modelEntry) error {
+	keys := make([]string, len(es))
+	order := make([]int, len(es))
+	for i, e := range es {
+		keys[i] = e.Prefix.String()
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+	for i := 1; i < len(order); i++ {
+		if keys[order[i]] == keys[order[i-1]] {
+			return fmt.Errorf("prefix [%s] appears twice", es[order[i]].Prefix.display())
+		}
+	}
+
+	// Number the words in order of first use.
+	ids := make(map[string]uint32)
+	var words []string
+	suffixCount, blobLen := 0, 0
+	for _, e := range es {
+		for _, s := range e.Suffixes {
+			if _, ok := ids[s.Word]; !ok {
+				ids[s.Word] = uint32(len(words))
+				words = append(words, s.Word)
+				blobLen += len(s.Word)
+			}
+		}
+		suffixCount += len(e.Suffixes)
+	}
+	for _, key := range keys {
+		blobLen += len(key)
+	}
+
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	var buf [prefixRecord]byte
+	bw.WriteString(indexMagic)
+	le.PutUint32(buf[:], uint32(len(hb)))
+	bw.Write(buf[:4])
+	bw.Write(hb)
+	for _, n := range []int{len(es), suffixCount, len(words), blobLen} {
+		le.PutUint64(buf[:], uint64(n))
+		bw.Write(buf[:8])
+	}
+	off, first := 0, 0
+	for _, i := range order {
+		le.PutUint64(buf[0:], uint64(off))
+		le.PutUint32(buf[8:], uint32(len(keys[i])))
+		le.PutUint64(buf[12:], uint64(first))
+		le.PutUint32(buf[20:], uint32(len(es[i].Suffixes)))
+		bw.Write(buf[:prefixRecord])
+		off += len(keys[i])
+		first += len(es[i].Suffixes)
+	}
+	for _, i := range order {
+		cum := 0
+		for _, s := range es[i].Suffixes {
+			cum += s.Count
+			le.PutUint32(buf[0:], ids[s.Word])
+			le.PutUint64(buf[4:], uint64(cum))
+			bw.Write(buf[:suffixRecord])
+		}
+	}
+	for _, word := range words {
+		le.PutUint64(buf[0:], uint64(off))
+		le.PutUint32(buf[8:], uint32(len(word)))
+		bw.Write(buf[:wordRecord])
+		off += len(word)
+	}
+	for _, i := range order {
+		bw.WriteString(keys[i])
+	}
+	for _, word := range words {
+		bw.WriteString(word)
+	}
+	return bw.Flush()
+}
+
+// indexModel is an index model held in memory or mapped from its file. Its
+// methods check every offset they read, so a corrupt record reads as a
+// missing one instead of crashing generation.
+type indexModel struct {
+	h        modelHeader
+	n        int    // number of prefixes
+	suffixN  uint64 // number of suffixes
+	wordN    uint64 // number of words
+	prefixes []byte
+	suffixes []byte
+	words    []byte
+	blob     []byte
+	unmap    func() error // releases the mapping, if any
+}
+
+// openIndex checks the header and the section sizes of the index model in
+// data.
+func openIndex(data []byte) (*indexModel, error) {
+	if !bytes.HasPrefix(data, []byte(indexMagic)) {
+		return nil, fmt.Errorf("not an index model")
+	}
+	rest := data[len(indexMagic):]
+	if len(rest) < 4 {
+		return nil, fmt.Errorf("index model is truncated")
+	}
+	hlen := uint64(le.Uint32(rest))
+	rest = rest[4:]
+	if uint64(len(rest)) < hlen+32 {
+		return nil, fmt.Errorf("index model is truncated")
+	}
+	m := new(indexModel)
+	dec := json.NewDecoder(bytes.NewReader(rest[:hlen]))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m.h); err != nil {
+		return nil, fmt.Errorf("bad index header: %v", err)
+	}
+	if err := checkHeader(&m.h); err != nil {
+		return nil, err
+	}
+	rest = rest[hlen:]
+	var counts [4]uint64
+	for i := range counts {
+		counts[i] = le.Uint64(rest[8*i:])
+		if counts[i] > uint64(len(rest)) {
+			return nil, fmt.Errorf("index model is truncated")
+		}
+	}
+	rest = rest[32:]
+	sizes := []uint64{counts[0] * prefixRecord, counts[1] * suffixRecord,
+		counts[2] * wordRecord, counts[3]}
+	if sizes[0]+sizes[1]+sizes[2]+sizes[3] != uint64(len(rest)) {
+		return nil, fmt.Errorf("index model is truncated or has trailing data")
+	}
+	m.n, m.suffixN, m.wordN = int(counts[0]), counts[1], counts[2]
+	m.prefixes, rest = rest[:sizes[0]], rest[sizes[0]:]
+	m.suffixes, rest = rest[:sizes[1]], rest[sizes[1]:]
+	m.words, m.blob = rest[:sizes[2]], rest[sizes[2]:]
+	return m, nil
+}
+
+// span returns the n bytes of the blob at off, or false if they lie
+// outside it.
+func (m *indexModel) span(off, n uint64) ([]byte, bool) {
+	if off > uint64(len(m.blob)) || n > uint64(len(m.blob))-off {
+		return nil, false
+	}
+	return m.blob[off : off+n], true
+}
+
+// key returns the key of prefix i.
+func (m *indexModel) key(i int) []byte {
+	r := m.prefixes[i*prefixRecord:]
+	b, _ := m.span(le.Uint64(r), uint64(le.Uint32(r[8:])))
+	return b
+}
+
+// find returns the number of the prefix with the given key, or -1.
+func (m *indexModel) find(key string) int {
+	i := sort.Search(m.n, func(i int) bool { return string(m.key(i)) >= key })
+	found := i < m.n && string(m.key(i)) == key
+	runtime.KeepAlive(m)
+	if !found {
+		return -1
+	}
+	return i
+}
+
+// word returns word number id.
+func (m *indexModel) word(id uint32) (string, bool) {
+	if uint64(id) >= m.wordN {
+		return "", false
+	}
+	r := m.words[int(id)*wordRecord:]
+	b, ok := m.span(le.Uint64(r), uint64(le.Uint32(r[8:])))
+	return string(b), ok
+}
+
+// entry returns the suffixes of prefix i, or nil if its record is corrupt.
+func (m *indexModel) entry(i int) *suffixes {
+	defer runtime.KeepAlive(m)
+	r := m.prefixes[i*prefixRecord:]
+	first, n := le.Uint64(r[12:]), uint64(le.Uint32(r[20:]))
+	if first > m.suffixN || n > m.suffixN-first {
+		return nil
+	}
+	s := &suffixes{words: make([]string, n), cum: make([]int, n)}
+	prev := uint64(0)
+	for j := range s.words {
+		sr := m.suffixes[(first+uint64(j))*suffixRecord:]
+		word, ok := m.word(le.Uint32(sr))
+		cum := le.Uint64(sr[4:])
+		if !ok || cum <= prev || cum > uint64(maxInt) {
+			return nil
+		}
+		s.words[j], s.cum[j], prev = word, int(cum), cum
+	}
+	return s
+}
+
+// pick returns the suffix of prefix i at index j of the list in which
+// every suffix is repeated as often as it was seen, like suffixes.pick,
+// reading only the word it returns. j must be in [0, m.total(i)). A
+// corrupt record gives the empty word.
+func (m *indexModel) pick(i, j int) string {
+	defer runtime.KeepAlive(m)
+	r := m.prefixes[i*prefixRecord:]
+	first, n := le.Uint64(r[12:]), uint64(le.Uint32(r[20:]))
+	if first > m.suffixN || n > m.suffixN-first {
+		return ""
+	}
+	k := sort.Search(int(n), func(k int) bool {
+		return le.Uint64(m.suffixes[(first+uint64(k))*suffixRecord+4:]) > uint64(j)
+	})
+	if k == int(n) {
+		return ""
+	}
+	word, _ := m.word(le.Uint32(m.suffixes[(first+uint64(k))*suffixRecord:]))
+	return word
+}
+
+// total returns the number of observations of prefix i.
+func (m *indexModel) total(i int) int {
+	defer runtime.KeepAlive(m)
+	r := m.prefixes[i*prefixRecord:]
+	first, n := le.Uint64(r[12:]), uint64(le.Uint32(r[20:]))
+	if n == 0 || first > m.suffixN || n > m.suffixN-first {
+		return 0
+	}
+	cum := le.Uint64(m.suffixes[(first+n-1)*suffixRecord+4:])
+	if cum > uint64(maxInt) {
+		return 0
+	}
+	return int(cum)
+}
+
+// mapIndex memory-maps the index model in the named file. The mapping is
+// released when the returned model is no longer used.
+func mapIndex(modelfile string) (*indexModel, error) {
+	data, unmap, err := mapFile(modelfile)
+	if err != nil {
+		return nil, err
+	}
+	m, err := openIndex(data)
+	if err != nil {
+		unmap()
+		return nil, &ModelError{0, 0, err}
+	}
+	m.unmap = unmap
+	runtime.SetFinalizer(m, func(m *indexModel) { m.unmap() })
+	return m, nil
+}
+
+// decodeIndex reads a whole index model into memory and feeds it to sink,
+// for the commands that work on counts rather than generate.
+func decodeIndex(br *bufio.Reader, sink modelSink) error {
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	m, err := openIndex(data)
+	if err != nil {
+		return &ModelError{0, 0, err}
+	}
+	sink.begin(m.h)
+	for i := 0; i < m.n; i++ {
+		key, s := m.key(i), m.entry(i)
+		if key == nil || s == nil {
+			return modelErrorf(0, 0, "prefix %d: corrupt record", i+1)
+		}
+		e := modelEntry{Prefix: splitKey(string(key))}
+		for j, word := range s.words {
+			e.Suffixes = append(e.Suffixes, suffixCount{word, s.count(j)})
+		}
+		if err := checkEntry(m.h, e); err != nil {
+			return modelErrorf(0, 0, "prefix %d: %w", i+1, err)
+		}
+		sink.add(e)
+	}
+	return nil
+}
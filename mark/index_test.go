@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestIndexGenerate checks that generating from a mapped index model gives
+// the same text as generating from the text model it was converted from.
+func TestIndexGenerate(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeCorpora(t, dir, 2, 5000)
+	for _, tc := range []struct {
+		name      string
+		newChain  func() *Chain
+		tokenizer string
+		opts      StreamOptions
+	}{
+		{"plain", func() *Chain { return NewChain(2) }, defaultTokenizer,
+			StreamOptions{MaxWords: 300}},
+		{"sampling", func() *Chain { return NewChain(2) }, defaultTokenizer,
+			StreamOptions{MaxWords: 300, Sampling: newSampling(0.7, 20, 0.9)}},
+		{"greedy", func() *Chain { return NewChain(2) }, defaultTokenizer,
+			StreamOptions{MaxWords: 300, Sampling: newSampling(0, 0, 1)}},
+		{"cycle window", func() *Chain { return NewChain(2) }, defaultTokenizer,
+			StreamOptions{MaxWords: 300, CycleWindow: 8}},
+		{"backoff", func() *Chain { return NewBackoffChain(3) }, defaultTokenizer,
+			StreamOptions{MaxWords: 300, Start: Prefix{"w1", "nowhere", "w2"}}},
+		{"sentences", func() *Chain { return NewChain(2) }, "sentence",
+			StreamOptions{Sentences: 20, MaxWords: 1000, Restart: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.newChain()
+			c.tokenizer = tc.tokenizer
+			if err := c.ReadFiles(paths, 1); err != nil {
+				t.Fatal(err)
+			}
+			text := filepath.Join(dir, tc.name+".txt")
+			index := filepath.Join(dir, tc.name+".idx")
+			if err := c.WriteModel(text, formatText, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := runConvert([]string{"-format", formatIndex, text, index}); err != nil {
+				t.Fatal(err)
+			}
+			fromText, err := ReadModelFile(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromIndex, err := ReadModelFile(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fromIndex.index == nil {
+				t.Fatal("index model was not mapped")
+			}
+			for seed := int64(1); seed <= 5; seed++ {
+				ctx := context.Background()
+				var want, got strings.Builder
+				fromText.Stream(ctx, &want, rand.New(rand.NewSource(seed)), tc.opts)
+				fromIndex.Stream(ctx, &got, rand.New(rand.NewSource(seed)), tc.opts)
+				if got.String() != want.String() {
+					t.Errorf("seed %d: index model generated\n%s\nwant\n%s",
+						seed, got.String(), want.String())
+				}
+				if want.Len() == 0 {
+					t.Errorf("seed %d: generated nothing", seed)
+				}
+			}
+			want := fromText.GenerateWithRand(rand.New(rand.NewSource(42)), 500)
+			if got := fromIndex.GenerateWithRand(rand.New(rand.NewSource(42)), 500); got != want {
+				t.Errorf("GenerateWithRand: index model generated\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stdinName is the input argument that stands for the standard input.
+const stdinName = "-"
+
+// Magic numbers of the compressed formats openInput recognises. A bzip2
+// stream starts with "BZh", a block size digit and either the magic of a
+// block or, when it is empty, that of the end of the stream.
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	bzip2Block  = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2Finish = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// openInput opens the named corpus, "-" meaning the standard input, and
+// decompresses it if it is gzip or bzip2 compressed. The format is told by
+// the contents rather than the file name, so compressed standard input
+// works too.
+func openInput(name string) (io.ReadCloser, error) {
+	var f io.ReadCloser = io.NopCloser(os.Stdin)
+	if name != stdinName {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+	r, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", inputName(name), err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// decompress returns a reader of the decompressed contents of r if r is
+// gzip or bzip2 compressed, and of r as it is otherwise.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(10)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case len(magic) == 10 && bytes.HasPrefix(magic, []byte("BZh")) &&
+		'1' <= magic[3] && magic[3] <= '9' &&
+		(bytes.Equal(magic[4:], bzip2Block) || bytes.Equal(magic[4:], bzip2Finish)):
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+// inputName returns how to name the input argument name in messages.
+func inputName(name string) string {
+	if name == stdinName {
+		return "standard input"
+	}
+	return name
+}
+
+// globList is a flag.Value collecting the globs of a repeated flag.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad glob %q", pattern)
+	}
+	*g = append(*g, pattern)
+	return nil
+}
+
+// matchAny reports whether name matches one of the globs.
+func matchAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandInputs turns the input arguments of read and update into the list
+// of corpora to read. "-" and files are kept as given, and an argument
+// naming no file is expanded as a glob. Directories are walked recursively
+// for the files whose base names match one of include, or any file if
+// include is empty, and none of exclude; the globs do not apply to files
+// named directly.
+func expandInputs(args []string, include, exclude []string) ([]string, error) {
+	var inputs []string
+	for _, arg := range args {
+		if arg == stdinName {
+			inputs = append(inputs, arg)
+			continue
+		}
+		paths := []string{arg}
+		if _, err := os.Stat(arg); os.IsNotExist(err) && strings.ContainsAny(arg, `*?[\`) {
+			paths, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad glob %q", arg)
+			}
+			if len(paths) == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+		}
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				inputs = append(inputs, path)
+				continue
+			}
+			err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				name := d.Name()
+				if (len(include) == 0 || matchAny(include, name)) && !matchAny(exclude, name) {
+					inputs = append(inputs, p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return inputs, nil
+}
@@ -47,10 +47,18 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 	"strconv"
 )
@@ -58,9 +66,25 @@ import (
 // Prefix is a Markov chain prefix of one or more words.
 type Prefix []string
 
-// String returns the Prefix as a string (for use as a map key).
+// String returns the Prefix as a string (for use as a map key). The words
+// are escaped by escapeWord before they are joined with spaces, so that
+// prefixes whose words contain spaces, like those of character models,
+// still give distinct keys.
 func (p Prefix) String() string {
-	return strings.Join(p, " ")
+	words := make([]string, len(p))
+	for i, word := range p {
+		words[i] = escapeWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+// splitKey returns the Prefix whose String is key.
+func splitKey(key string) Prefix {
+	p := Prefix(strings.Split(key, " "))
+	for i, word := range p {
+		p[i], _ = unescapeWord(word) // keys are always escaped correctly
+	}
+	return p
 }
 
 // Shift removes the first word from the Prefix and appends the given word.
@@ -73,203 +97,853 @@ func (p Prefix) Shift(word string) {
 // frequencies.
 // A prefix is a string of prefixLen words joined with spaces.
 // A suffix is a single word. A prefix can have multiple suffixes.
+// A backoff chain also counts the shorter prefixes of minOrder up to
+// prefixLen words in the same map; otherwise minOrder equals prefixLen.
+// The words are the tokens of the named Tokenizer.
 type Chain struct {
 	chain     map[string]map[string]int
 	prefixLen int
+	minOrder  int
+	tokenizer string
 }
 
 
-// ChainForGenerate contains a map ("chain") of prefixes to a list of suffixes.
+// ChainForGenerate contains a map ("chain") of prefixes to weighted suffixes.
 // A prefix is a string of prefixLen words joined with spaces.
 // A suffix is a single word. A prefix can have multiple suffixes.
 type ChainForGenerate struct {
-	chain     map[string][]string
+	chain     map[string]*suffixes
 	prefixLen int
+	minOrder  int // shortest prefix to back off to, see Chain
+	tokenizer string
+	index     *indexModel // set instead of chain for a mapped index model
+
+	startsOnce sync.Once
+	starts     *suffixes // sentence-start prefixes, see sentenceStarts
+}
+
+// suffixes holds the suffixes of one prefix with their cumulative
+// frequencies, so a suffix can be drawn in proportion to its frequency by
+// binary search instead of storing one copy of the word per occurrence.
+type suffixes struct {
+	words []string
+	cum   []int // cum[i] is the total frequency of words[0..i]
+
+	// The suffixes of prefix rec of a mapped index model leave words
+	// and cum nil and are read from index instead: only what total and
+	// pick need, or all of them through decoded.
+	index *indexModel
+	rec   int
+}
+
+// add appends word with the given frequency. Frequencies below 1 are
+// ignored, as such a word can never be drawn.
+func (s *suffixes) add(word string, frequency int) {
+	if frequency < 1 {
+		return
+	}
+	s.words = append(s.words, word)
+	s.cum = append(s.cum, s.total()+frequency)
+}
+
+// total returns the sum of the frequencies of all suffixes.
+func (s *suffixes) total() int {
+	if s.index != nil {
+		return s.index.total(s.rec)
+	}
+	if len(s.cum) == 0 {
+		return 0
+	}
+	return s.cum[len(s.cum)-1]
+}
+
+// pick returns the word at index i of the list in which every suffix is
+// repeated frequency times, in the order they were added.
+// i must be in [0, total()).
+func (s *suffixes) pick(i int) string {
+	if s.index != nil {
+		return s.index.pick(s.rec, i)
+	}
+	return s.words[sort.SearchInts(s.cum, i+1)]
 }
 
 // NewChain returns a new Chain with prefixes of prefixLen words.
 func NewChain(prefixLen int) *Chain {
-	return &Chain{make(map[string]map[string]int), prefixLen}
+	return &Chain{make(map[string]map[string]int), prefixLen, prefixLen,
+		defaultTokenizer}
+}
+
+// NewBackoffChain returns a new Chain that counts prefixes of every length
+// from 1 to maxOrder words, so that generation can back off to a shorter
+// prefix when a long one has no suffixes.
+func NewBackoffChain(maxOrder int) *Chain {
+	return &Chain{make(map[string]map[string]int), maxOrder, 1, defaultTokenizer}
+}
+
+// newEmpty returns an empty Chain with the same settings as c.
+func (c *Chain) newEmpty() *Chain {
+	return &Chain{make(map[string]map[string]int), c.prefixLen, c.minOrder,
+		c.tokenizer}
 }
 
 // NewChianForGenerate returns a new ChainForGenerate with prefixes of
 // prefixLen words.
 func NewChianForGenerate(prefixLen int) *ChainForGenerate {
-	return &ChainForGenerate{make(map[string][]string), prefixLen}
+	return &ChainForGenerate{chain: make(map[string]*suffixes), prefixLen: prefixLen,
+		minOrder: prefixLen, tokenizer: defaultTokenizer}
+}
+
+// get returns the suffixes of the prefix with the given key, or nil.
+func (c *ChainForGenerate) get(key string) *suffixes {
+	if c.index != nil {
+		i := c.index.find(key)
+		if i < 0 {
+			return nil
+		}
+		return &suffixes{index: c.index, rec: i}
+	}
+	return c.chain[key]
+}
+
+// each calls fn with the key and the number of observations of every
+// prefix, in no particular order.
+func (c *ChainForGenerate) each(fn func(key string, total int)) {
+	if c.index != nil {
+		for i := 0; i < c.index.n; i++ {
+			if key := c.index.key(i); key != nil {
+				fn(string(key), c.index.total(i))
+			}
+		}
+		return
+	}
+	for key, choices := range c.chain {
+		fn(key, choices.total())
+	}
+}
+
+// size returns the number of prefixes of c.
+func (c *ChainForGenerate) size() int {
+	if c.index != nil {
+		return c.index.n
+	}
+	return len(c.chain)
 }
 
-// Generate returns a string of at most n words generated from Chain.
+// lookup returns the suffixes of the longest known tail of p that is at
+// least minOrder words long, or nil if there is none.
+func (c *ChainForGenerate) lookup(p Prefix) *suffixes {
+	for k := len(p); k >= c.minOrder; k-- {
+		if choices := c.get(p[len(p)-k:].String()); choices != nil && choices.total() > 0 {
+			return choices
+		}
+	}
+	return nil
+}
+
+// Generate returns a string of at most n words generated from Chain, using
+// a random source of its own seeded from the clock.
 func (c *ChainForGenerate) Generate(n int) string {
+	return c.GenerateWithRand(rand.New(rand.NewSource(time.Now().UnixNano())), n)
+}
+
+// GenerateWithRand returns a string of at most n words generated from
+// Chain, drawing every suffix from rng. The same model, seed and n always
+// give the same text. rng must not be shared with other goroutines.
+func (c *ChainForGenerate) GenerateWithRand(rng *rand.Rand, n int) string {
+	return c.GenerateFrom(rng, nil, n)
+}
+
+// GenerateFrom is like GenerateWithRand but continues from the prefix start
+// instead of the empty prefix. A start shorter than prefixLen, such as nil,
+// is padded with empty words in front. start is not modified.
+func (c *ChainForGenerate) GenerateFrom(rng *rand.Rand, start Prefix, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	var b strings.Builder
+	c.Stream(context.Background(), &b, rng, StreamOptions{Start: start, MaxWords: n})
+	return b.String()
+}
+
+// GenerateSentences returns the words that complete k sentences from start
+// (nil for the beginning), generated from a model built with the sentence
+// tokenizer and drawing every suffix from rng. If maxWords is positive it
+// stops after that many words even if fewer sentences are complete.
+func (c *ChainForGenerate) GenerateSentences(rng *rand.Rand, start Prefix, k, maxWords int) string {
+	var b strings.Builder
+	c.Stream(context.Background(), &b, rng,
+		StreamOptions{Start: start, MaxWords: maxWords, Sentences: k})
+	return b.String()
+}
+
+// Join returns the text made of generated words, spaced the way the
+// model's tokenizer split them.
+func (c *ChainForGenerate) Join(words []string) string {
+	return joinTokens(tokenizers[c.tokenizer], words)
+}
+
+// generator walks a ChainForGenerate, producing one token at a time.
+type generator struct {
+	c         *ChainForGenerate
+	rng       *rand.Rand
+	sampling  Sampling
+	p         Prefix
+	sentences int // number of sentenceEnd markers produced
+
+	restart  bool   // continue from a sentence start at a dead end
+	restarts int    // number of such restarts
+	window   int    // steps to look back for cycles, 0 for none
+	recent   []step // the last window steps
+}
+
+// step is a prefix the generator was at and the suffix it drew there.
+type step struct {
+	key, word string
+}
+
+// newGenerator returns a generator that continues from start, padded with
+// empty words in front to the prefix length.
+func (c *ChainForGenerate) newGenerator(rng *rand.Rand, start Prefix) *generator {
 	p := make(Prefix, c.prefixLen)
-	var words []string
-	for i := 0; i < n; i++ {
-		choices := c.chain[p.String()]
-		if len(choices) == 0 {
-			break
+	copy(p[len(p)-len(start):], start)
+	return &generator{c: c, rng: rng, p: p}
+}
+
+// next returns the next token, including sentence markers, or false if the
+// current prefix has no suffixes. After a sentenceEnd the generator starts
+// again from the empty prefix, as Chain.Read does at every sentenceStart.
+//
+// With restart set, a prefix without suffixes is replaced by a random
+// sentence start instead. With a window, a prefix seen in the last window
+// steps draws from the suffixes not drawn there before, if any are left,
+// so that the generator leaves short cycles.
+func (g *generator) next() (string, bool) {
+	choices := g.c.lookup(g.p)
+	if choices == nil && g.restart {
+		if starts := g.c.sentenceStarts(); starts.total() > 0 {
+			copy(g.p, splitKey(starts.pick(g.rng.Intn(starts.total()))))
+			g.restarts++
+			choices = g.c.lookup(g.p)
 		}
-	// Intn returns, as an int, a non-negative pseudo-random number in [0,n)
-		next := choices[rand.Intn(len(choices))] 
-		words = append(words, next)
-		p.Shift(next)
 	}
-	return strings.Join(words, " ")
+	if choices == nil {
+		return "", false
+	}
+	var key string
+	if g.window > 0 {
+		key = g.p.String()
+		var drawn []string
+		for _, st := range g.recent {
+			if st.key == key {
+				drawn = append(drawn, st.word)
+			}
+		}
+		if alt := choices.without(drawn); alt != nil {
+			choices = alt
+		}
+	}
+	next := choices.sample(g.rng, g.sampling)
+	if g.window > 0 {
+		if len(g.recent) == g.window {
+			g.recent = append(g.recent[:0], g.recent[1:]...)
+		}
+		g.recent = append(g.recent, step{key, next})
+	}
+	if next == sentenceEnd {
+		g.sentences++
+		for i := range g.p {
+			g.p[i] = ""
+		}
+	} else {
+		g.p.Shift(next)
+	}
+	return next, true
 }
 
-func (c *Chain) Read(filePath string) {
-	// open the file, return a Reader
-	r, err := os.Open(filePath)
+// StartPrefix returns the prefix from which to continue the given words:
+// the last prefixLen of them, padded with empty words if there are fewer.
+// If the model never saw that prefix, a backoff model keeps it and backs
+// off to its longest known tail; otherwise StartPrefix falls back to the
+// known prefix that shares the most trailing words with it (preferring the
+// most frequent one), or to the empty prefix if none does. It returns a
+// note describing the fallback, which is empty when the prefix is known.
+func (c *ChainForGenerate) StartPrefix(words []string) (Prefix, string) {
+	p := make(Prefix, c.prefixLen)
+	if len(words) > len(p) {
+		words = words[len(words)-len(p):]
+	}
+	copy(p[len(p)-len(words):], words)
+	if c.get(p.String()) != nil {
+		return p, ""
+	}
+	for k := len(p) - 1; k >= c.minOrder; k-- {
+		if c.get(p[len(p)-k:].String()) != nil {
+			return p, fmt.Sprintf("prefix [%s] is unknown, backing off to [%s]",
+				p.display(), p[len(p)-k:].display())
+		}
+	}
+
+	var (
+		best      Prefix
+		bestMatch int
+		bestTotal int
+	)
+	c.each(func(key string, t int) {
+		q := splitKey(key)
+		match := 0
+		for match < len(p) && match < len(q) && q[len(q)-1-match] == p[len(p)-1-match] {
+			match++
+		}
+		if match == 0 || match < bestMatch {
+			return
+		}
+		if match > bestMatch || t > bestTotal ||
+			(t == bestTotal && comparePrefix(q, best) < 0) {
+			best, bestMatch, bestTotal = q, match, t
+		}
+	})
+	if best == nil {
+		return make(Prefix, c.prefixLen), fmt.Sprintf("no known prefix ends"+
+			" like [%s], starting from the beginning", p.display())
+	}
+	return best, fmt.Sprintf("prefix [%s] is unknown, continuing from [%s]"+
+		" which shares its last %d word(s)", p.display(), best.display(), bestMatch)
+}
+
+// Read counts the tokens read from r into c, starting from the empty
+// prefix. r can be any source of text; ReadFile opens files for it.
+func (c *Chain) Read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	p := make(Prefix, c.prefixLen) // starts as all empty words
+	return tokenizers[c.tokenizer].Tokenize(br, func(s string) {
+		if s == sentenceStart { // every sentence starts from the empty prefix
+			for i := range p {
+				p[i] = ""
+			}
+		}
+		for k := c.minOrder; k <= c.prefixLen; k++ {
+			key := p[len(p)-k:].String()
+			tf, ok := c.chain[key]  // term frequency vector of a certian prefix
+			if !ok {				// if this prefix is not in the map 
+				tf = make(map[string]int) 
+				c.chain[key] = tf
+			}
+			tf[s]++
+		}
+		p.Shift(s)
+	})
+}
+
+// ReadFile counts the tokens of the named file into c. "-" names the
+// standard input, and gzip and bzip2 files are decompressed.
+func (c *Chain) ReadFile(filePath string) error {
+	r, err := openInput(filePath)
 	if err != nil {
-		fmt.Println("Error: Could not open file " + filePath)
-		return 
+		return err
 	}
 	defer r.Close()
+	if err := c.Read(r); err != nil {
+		return fmt.Errorf("reading %s: %w", inputName(filePath), err)
+	}
+	return nil
+}
 
-	br := bufio.NewReader(r)
-	p := make(Prefix, c.prefixLen)
-	for i, _ := range p {		// replace all empty string with '\"\"''
-		p[i] = "\"\""
+// WriteModel writes the Chain to outfilename in the given format
+// (text, json, gob or index). With canonical set, prefixes and suffixes are
+// written in sorted order, so that training twice on the same corpus gives
+// identical files. The file is replaced whole, never rewritten in place;
+// see writeModelFile.
+func (c *Chain) WriteModel(outfilename, format string, canonical bool) error {
+	return writeModelFile(outfilename, func(w io.Writer) error {
+		return encodeModel(w, c, format, canonical)
+	})
+}
+
+// Merge adds the counts of other to c. Both chains must have the same
+// prefix length and orders.
+func (c *Chain) Merge(other *Chain) error {
+	if other.prefixLen != c.prefixLen {
+		return fmt.Errorf("cannot merge a chain with prefix length %d into"+
+			" one with prefix length %d", other.prefixLen, c.prefixLen)
 	}
-	for {
-		var s string
-		if _, err := fmt.Fscan(br, &s); err != nil {
-			break
-		}
-		key := p.String()
-		tf, ok := c.chain[key]  // term frequency vector of a certian prefix
-		if !ok {				// if this prefix is not in the map 
-			tf = make(map[string]int) 
+	if other.minOrder != c.minOrder {
+		return fmt.Errorf("cannot merge a chain with orders %d..%d into"+
+			" one with orders %d..%d", other.minOrder, other.prefixLen,
+			c.minOrder, c.prefixLen)
+	}
+	if other.tokenizer != c.tokenizer {
+		return fmt.Errorf("cannot merge a chain of %s tokens into one of"+
+			" %s tokens", other.tokenizer, c.tokenizer)
+	}
+	for key, otf := range other.chain {
+		tf, ok := c.chain[key]
+		if !ok {
+			tf = make(map[string]int, len(otf))
 			c.chain[key] = tf
 		}
-		tf[s]++
-		p.Shift(s)
+		for s, n := range otf {
+			tf[s] += n
+		}
 	}
+	return nil
 }
 
-func (c *Chain) WriteModel(outfilename string) {
-	out, err := os.Create(outfilename) // Create outputfile.
-	if err != nil {
-		fmt.Println("Error! Couldn't create " + outfilename)
-		return
+// ReadFiles reads the given files with up to workers goroutines, each
+// counting into a Chain of its own, and merges the results into c. The
+// counts are the same as reading the files one after the other. It stops
+// at the first file that cannot be read and returns its error.
+func (c *Chain) ReadFiles(filePaths []string, workers int) error {
+	if workers > len(filePaths) {
+		workers = len(filePaths)
+	}
+	if workers <= 1 {
+		for _, filePath := range filePaths {
+			if err := c.ReadFile(filePath); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	defer out.Close()
 
-	fmt.Fprintln(out, c.prefixLen)
-	for k, v := range c.chain { // iterate over all prefix strings
-		fmt.Fprint(out, k + " ")
-		for _k, _v := range v { // iterate over all term frequencies
-			fmt.Fprint(out, _k + " ")
-			fmt.Fprint(out, _v) 
-			fmt.Fprint(out, " ")
+	paths := make(chan string)
+	stop := make(chan struct{}, 1) // signalled by the first worker to fail
+	type result struct {
+		c   *Chain
+		err error
+	}
+	results := make(chan result)
+	for i := 0; i < workers; i++ {
+		go func() {
+			wc := c.newEmpty()
+			var err error
+			for filePath := range paths {
+				if err = wc.ReadFile(filePath); err != nil {
+					select {
+					case stop <- struct{}{}:
+					default:
+					}
+					break
+				}
+			}
+			results <- result{wc, err}
+		}()
+	}
+	// Hand out the files until they run out or a worker fails.
+feed:
+	for _, filePath := range filePaths {
+		select {
+		case paths <- filePath:
+		case <-stop:
+			break feed
+		}
+	}
+	close(paths)
+
+	var first error
+	for i := 0; i < workers; i++ {
+		r := <-results
+		switch {
+		case first != nil:
+		case r.err != nil:
+			first = r.err
+		case len(c.chain) == 0: // nothing to merge into yet
+			c.chain = r.c.chain
+		default:
+			first = c.Merge(r.c)
 		}
-		fmt.Fprint(out, "\n")
 	}
-	out.Close()
+	return first
 }
 
-func ReadModel(modelfile string) *ChainForGenerate {
-	var  (
-		prefixLen int
-		p Prefix
-	)
+// ReadChain reads the counts of a model written by WriteModel in any
+// format, so that it can be extended and written again. It also returns
+// the format of the model.
+func ReadChain(r io.Reader) (*Chain, string, error) {
+	c := new(Chain)
+	format, err := decodeModel(r, c)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, format, nil
+}
 
+// ReadChainFile is ReadChain for the named model file.
+func ReadChainFile(modelfile string) (*Chain, string, error) {
 	r, err := os.Open(modelfile) //open model file
 	if err != nil {
-		fmt.Println("Error: Could not open file " + modelfile)
-		return nil
+		return nil, "", err
 	}
 	defer r.Close()
+	c, format, err := ReadChain(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", modelfile, err)
+	}
+	return c, format, nil
+}
 
-	// read the prefix length
-	scanner := bufio.NewScanner(r)
+// begin and add make Chain a modelSink for decodeModel.
+func (c *Chain) begin(h modelHeader) {
+	*c = *NewChain(h.PrefixLen)
+	c.minOrder = h.MinOrder
+	c.tokenizer = h.Tokenizer
+}
 
-	if scanner.Scan() {
-		var err error
-		prefixLen, err = strconv.Atoi(scanner.Text())
-		if err != nil {
-			fmt.Println("Error: prefix length should be an integer >= 1")
-			return nil
-		}
+func (c *Chain) add(e modelEntry) {
+	key := e.Prefix.String()
+	tf, ok := c.chain[key]
+	if !ok {
+		tf = make(map[string]int, len(e.Suffixes))
+		c.chain[key] = tf
+	}
+	for _, s := range e.Suffixes {
+		tf[s.Word] += s.Count
 	}
-	c := NewChianForGenerate(prefixLen) // Initialize a new Chain.
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()			// read line
-		splited := strings.Fields(line)	// split the line, get a slice of words
+// ReadModel reads a model written by WriteModel in any format, detecting
+// the format from its contents. A malformed model gives a *ModelError,
+// telling where the problem is in text and json models. An index model is read whole
+// into memory; ReadModelFile maps it instead.
+func ReadModel(r io.Reader) (*ChainForGenerate, error) {
+	c := new(ChainForGenerate)
+	if _, err := decodeModel(r, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-		p = splited[0:prefixLen]		// get term
-		// replace all \"\" with empty string
-		for i := 0; i < len(p); i++ {
-			if p[i] == "\"\"" {
-				p[i] = ""
-			}
+// ReadModelFile is ReadModel for the named model file, except that an
+// index model is memory-mapped and read only as generation needs it.
+func ReadModelFile(modelfile string) (*ChainForGenerate, error) {
+	r, err := os.Open(modelfile) //open model file
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	if detectFormat(br) == formatIndex {
+		m, err := mapIndex(modelfile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", modelfile, err)
 		}
-		key := p.String()
-		
-		for i := prefixLen; i < len(splited); i += 2 {
-			// get term frequency
-			frequency, err := strconv.Atoi(splited[i+1])
-			if err != nil {
-				return nil
-			}
+		return &ChainForGenerate{prefixLen: m.h.PrefixLen, minOrder: m.h.MinOrder,
+			tokenizer: m.h.Tokenizer, index: m}, nil
+	}
+	c, err := ReadModel(br)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", modelfile, err)
+	}
+	return c, nil
+}
 
-			term := splited[i]	// get term
-			// add frequency times of term into slice
-			for j := 0; j < frequency; j++ {
-				c.chain[key] = append(c.chain[key], term)
-			}
-		}
+// begin and add make ChainForGenerate a modelSink for decodeModel.
+func (c *ChainForGenerate) begin(h modelHeader) {
+	c.chain = make(map[string]*suffixes)
+	c.prefixLen = h.PrefixLen
+	c.minOrder = h.MinOrder
+	c.tokenizer = h.Tokenizer
+}
+
+func (c *ChainForGenerate) add(e modelEntry) {
+	key := e.Prefix.String()
+	choices, ok := c.chain[key]
+	if !ok {
+		choices = new(suffixes)
+		c.chain[key] = choices
+	}
+	for _, s := range e.Suffixes {
+		choices.add(s.Word, s.Count)
 	}
-	return c
 }
 
+// usageError is a mistake on the command line. main exits with status 2
+// for it, as the flag package does for a bad flag, and with status 1 for
+// any other error.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
 func main() {
+	var err error
 	if len(os.Args) < 2 {
-		fmt.Println("Error: command should be: mark COMMAND options")
-		return
+		err = usageError("command should be: mark COMMAND options")
+	} else {
+		switch os.Args[1] {
+		case "read":
+			err = runRead(os.Args[2:])
+		case "update":
+			err = runUpdate(os.Args[2:])
+		case "generate":
+			err = runGenerate(os.Args[2:])
+		case "diff":
+			err = runDiff(os.Args[2:])
+		case "eval":
+			err = runEval(os.Args[2:])
+		case "serve":
+			err = runServe(os.Args[2:])
+		case "prune":
+			err = runPrune(os.Args[2:])
+		case "stats":
+			err = runStats(os.Args[2:])
+		case "query":
+			err = runQuery(os.Args[2:])
+		case "convert":
+			err = runConvert(os.Args[2:])
+		default:
+			err = usageError("command should be read, update, generate, diff," +
+				" eval, serve, prune, stats, query or convert")
+		}
 	}
-	command := os.Args[1]
-	if command == "read" { 				// read
-		if len(os.Args) < 5 {
-			fmt.Println("Error: read command should be: mark read N" + 
-				" outfilename infile1 infile2 .... ")
-			return
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		if _, ok := err.(usageError); ok {
+			os.Exit(2)
 		}
+		os.Exit(1)
+	}
+}
 
-		prefixLen, err := strconv.Atoi(os.Args[2])
-		if err != nil {
-			fmt.Println("Error: prefix length should be an integer >= 1")
-			return
-		}
-		c := NewChain(prefixLen) // Initialize a new Chain.
+// runRead builds a model from input files, directories of them, or the
+// standard input given as "-": mark read N outfilename infile...
+func runRead(args []string) error {
+	flags := flag.NewFlagSet("read", flag.ExitOnError)
+	format := flags.String("format", formatText,
+		"model file format: text, json, gob or index")
+	workers := flags.Int("j", runtime.NumCPU(),
+		"number of input files to read concurrently")
+	canonical := flags.Bool("canonical", false,
+		"write prefixes and suffixes in sorted order")
+	maxOrder := flags.Int("max-order", 0,
+		"build a backoff model with prefixes of 1 to N words instead of"+
+			" taking the prefix length N as the first argument")
+	tokenizer := flags.String("tokenizer", defaultTokenizer,
+		"how to split the input: whitespace, punct or sentence")
+	unit := flags.String("unit", "word",
+		"what the model is made of: word, or char for UTF-8 characters")
+	var include, exclude globList
+	flags.Var(&include, "include",
+		"read only the files of input directories matching this glob (repeatable)")
+	flags.Var(&exclude, "exclude",
+		"skip the files of input directories matching this glob (repeatable)")
+	flags.Parse(args)
+	args = flags.Args()
+	if *maxOrder > 0 {
+		// The prefix length comes from the flag; keep the positional
+		// arguments in their usual places.
+		args = append([]string{strconv.Itoa(*maxOrder)}, args...)
+	}
+	if len(args) < 3 {
+		return usageError("read command should be: mark read" +
+			" [--format=text|json|gob|index] [-j workers] [-canonical]" +
+			" [--tokenizer=whitespace|punct|sentence] [--unit=word|char]" +
+			" [-include glob] [-exclude glob]" +
+			" N|--max-order N outfilename infile1|dir|- infile2 .... ")
+	}
+	if !validFormat(*format) {
+		return usageError("format should be text, json, gob or index")
+	}
+	if _, ok := tokenizers[*tokenizer]; !ok {
+		return usageError("tokenizer should be whitespace, punct or sentence")
+	}
+	switch {
+	case *unit == "char" && isFlagSet(flags, "tokenizer"):
+		return usageError("--tokenizer cannot be used with --unit=char")
+	case *unit == "char":
+		*tokenizer = "char"
+	case *unit != "word":
+		return usageError("unit should be word or char")
+	}
+
+	prefixLen, err := strconv.Atoi(args[0])
+	if err != nil || prefixLen < 1 {
+		return usageError("prefix length should be an integer >= 1")
+	}
+	c := NewChain(prefixLen) // Initialize a new Chain.
+	if *maxOrder > 0 {
+		c = NewBackoffChain(*maxOrder)
+	}
+	c.tokenizer = *tokenizer
 
-		outfilename := os.Args[3]
+	outfilename := args[1]
 
-		for i := 3; i < len(os.Args); i++ {
-			c.Read(os.Args[i])
-		}
+	inputs, err := expandInputs(args[2:], include, exclude)
+	if err != nil {
+		return err
+	}
+	if err := c.ReadFiles(inputs, *workers); err != nil {
+		return err
+	}
 
-		c.WriteModel(outfilename)
+	return c.WriteModel(outfilename, *format, *canonical)
+}
 
-	} else if (command == "generate") { // generate
-		if len(os.Args) < 4 {
-			fmt.Println("Error: generate command should be: mark generate" + 
-				" modelfile n")
-			return
+// runUpdate adds the counts of new input files to an existing model and
+// rewrites it: mark update modelfile infile...
+func runUpdate(args []string) error {
+	flags := flag.NewFlagSet("update", flag.ExitOnError)
+	format := flags.String("format", "",
+		"model file format: text, json, gob or index (default: keep the current one)")
+	workers := flags.Int("j", runtime.NumCPU(),
+		"number of input files to read concurrently")
+	canonical := flags.Bool("canonical", false,
+		"write prefixes and suffixes in sorted order")
+	var include, exclude globList
+	flags.Var(&include, "include",
+		"read only the files of input directories matching this glob (repeatable)")
+	flags.Var(&exclude, "exclude",
+		"skip the files of input directories matching this glob (repeatable)")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) < 2 {
+		return usageError("update command should be: mark update" +
+			" [--format=text|json|gob|index] [-j workers] [-canonical]" +
+			" [-include glob] [-exclude glob] modelfile infile1|dir|- infile2 .... ")
+	}
+	if *format != "" && !validFormat(*format) {
+		return usageError("format should be text, json, gob or index")
+	}
+
+	modelfile := args[0]
+	c, modelFormat, err := ReadChainFile(modelfile)
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = modelFormat
+	}
+
+	inputs, err := expandInputs(args[1:], include, exclude)
+	if err != nil {
+		return err
+	}
+	added := c.newEmpty()
+	if err := added.ReadFiles(inputs, *workers); err != nil {
+		return err
+	}
+	if err := c.Merge(added); err != nil {
+		return err
+	}
+
+	// WriteModel renames the new model over the old one, so that a
+	// failed write leaves the old model in place.
+	return c.WriteModel(modelfile, *format, *canonical)
+}
+
+// runGenerate prints text generated from a model: mark generate modelfile n
+func runGenerate(args []string) error {
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	seed := flags.Int64("seed", 0,
+		"seed for the random number generator (default: the current time)")
+	start := flags.String("start", "",
+		"phrase to continue; its last words are the starting prefix")
+	sentences := flags.Int("sentences", 0,
+		"emit this many complete sentences (sentence models only);"+
+			" n, if given, limits the number of words")
+	stop := flags.String("stop", "", "stop after writing this word")
+	stopRegexp := flags.String("stop-regexp", "",
+		"stop after writing a word that matches this regular expression")
+	maxBytes := flags.Int("max-bytes", 0, "write at most this many bytes")
+	temperature := flags.Float64("temperature", 1,
+		"above 1 flattens, below 1 sharpens the suffix distribution;"+
+			" 0 always draws the most frequent suffix")
+	topK := flags.Int("top-k", 0, "draw only from the k most frequent suffixes (0: all)")
+	topP := flags.Float64("top-p", 1,
+		"draw only from the most frequent suffixes covering this probability")
+	restart := flags.Bool("restart", false,
+		"continue from a random sentence start instead of stopping at a dead end")
+	cycleWindow := flags.Int("cycle-window", 0,
+		"prefer other suffixes at a prefix seen in the last k words (0: off)")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) < 2 && !(len(args) == 1 && *sentences > 0) {
+		return usageError("generate command should be: mark generate" +
+			" [-seed n] [--start phrase] [--sentences k] [-stop word]" +
+			" [-stop-regexp re] [-max-bytes n] [--temperature t]" +
+			" [--top-k k] [--top-p p] [-restart] [-cycle-window k] modelfile n")
+	}
+	opts := StreamOptions{StopToken: *stop, MaxBytes: *maxBytes,
+		Restart: *restart, CycleWindow: *cycleWindow}
+	if *cycleWindow < 0 {
+		return usageError("-cycle-window should be >= 0")
+	}
+	if !validSampling(*temperature, *topK, *topP) {
+		return usageError("--temperature and --top-k should be >= 0," +
+			" --top-p between 0 and 1")
+	}
+	opts.Sampling = newSampling(*temperature, *topK, *topP)
+	if *stopRegexp != "" {
+		re, err := regexp.Compile(*stopRegexp)
+		if err != nil {
+			return usageError("bad -stop-regexp: " + err.Error())
 		}
+		opts.StopRegexp = re
+	}
+	if !isFlagSet(flags, "seed") {
+		*seed = time.Now().UnixNano()
+	}
 
-		c := ReadModel(os.Args[2])
+	c, err := ReadModelFile(args[0])
+	if err != nil {
+		return err
+	}
 
-		rand.Seed(time.Now().UnixNano()) // Seed the random number generator.
+	rng := rand.New(rand.NewSource(*seed)) // Seed the random number generator.
 
-		numOfWords, err := strconv.Atoi(os.Args[3])
+	if len(args) > 1 {
+		numOfWords, err := strconv.Atoi(args[1])
 		if err != nil {
-			fmt.Println("Error: n-4 th parameter should be an integer")
-			return
+			return usageError("n-4 th parameter should be an integer")
+		}
+		if numOfWords <= 0 { // nothing to generate
+			fmt.Println()
+			return nil
+		}
+		opts.MaxWords = numOfWords
+	}
+	if *sentences > 0 && c.tokenizer != "sentence" {
+		return usageError("--sentences needs a model read with --tokenizer=sentence")
+	}
+	opts.Sentences = *sentences
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if *start != "" {
+		words := tokenize(c.tokenizer, *start)
+		p, note := c.StartPrefix(words)
+		if note != "" {
+			fmt.Fprintln(os.Stderr, "mark: "+note)
+		}
+		var shown []string
+		for _, word := range words {
+			if word != sentenceStart {
+				shown = append(shown, word)
+			}
+		}
+		out.WriteString(c.Join(shown))
+		opts.Start = p
+		if len(shown) > 0 {
+			opts.After = shown[len(shown)-1]
 		}
-		text := c.Generate(numOfWords) // Generate text.
-		fmt.Println(text)
-	} else {
-		fmt.Println("Error: command should be either read or generate")
-		return
 	}
-}
\ No newline at end of file
+
+	// Stop cleanly on an interrupt, keeping what was written so far.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	// Generate text.
+	if _, err := c.Stream(ctx, out, rng, opts); err != nil && ctx.Err() == nil {
+		return err
+	}
+	out.WriteString("\n")
+	return out.Flush()
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
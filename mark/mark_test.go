@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCorpora writes n synthetic corpora of words words each to dir and
+// returns their paths. Words are drawn from a Zipf distribution over a
+// fixed vocabulary, with a full stop now and then, so that the corpora
+// share most of their prefixes like real text does.
+func writeCorpora(tb testing.TB, dir string, n, words int) []string {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.1, 1, 4999)
+	var paths []string
+	for i := 0; i < n; i++ {
+		var b strings.Builder
+		for j := 0; j < words; j++ {
+			fmt.Fprintf(&b, "w%d", zipf.Uint64())
+			if rng.Intn(12) == 0 {
+				b.WriteString(".")
+			}
+			if j%15 == 14 {
+				b.WriteString("\n")
+			} else {
+				b.WriteString(" ")
+			}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("corpus%d.txt", i))
+		if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// TestReadFilesWorkers checks that reading with any number of workers
+// gives byte-identical canonical models in every format.
+func TestReadFilesWorkers(t *testing.T) {
+	paths := writeCorpora(t, t.TempDir(), 7, 3000)
+	for _, tc := range []struct {
+		name      string
+		newChain  func() *Chain
+		tokenizer string
+	}{
+		{"prefix2", func() *Chain { return NewChain(2) }, defaultTokenizer},
+		{"backoff3", func() *Chain { return NewBackoffChain(3) }, defaultTokenizer},
+		{"sentence", func() *Chain { return NewChain(2) }, "sentence"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			models := make(map[int]map[string][]byte)
+			for _, workers := range []int{1, 2, 4, len(paths)} {
+				c := tc.newChain()
+				c.tokenizer = tc.tokenizer
+				if err := c.ReadFiles(paths, workers); err != nil {
+					t.Fatalf("-j %d: %v", workers, err)
+				}
+				models[workers] = make(map[string][]byte)
+				for _, format := range []string{formatText, formatJSON, formatGob, formatIndex} {
+					var buf bytes.Buffer
+					if err := encodeModel(&buf, c, format, true); err != nil {
+						t.Fatalf("-j %d, %s: %v", workers, format, err)
+					}
+					models[workers][format] = buf.Bytes()
+				}
+			}
+			for workers, m := range models {
+				for format, b := range m {
+					if !bytes.Equal(b, models[1][format]) {
+						t.Errorf("-j %d: %s model differs from -j 1", workers, format)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadFilesError(t *testing.T) {
+	paths := writeCorpora(t, t.TempDir(), 4, 100)
+	paths = append(paths[:2], append([]string{filepath.Join(t.TempDir(), "missing.txt")},
+		paths[2:]...)...)
+	for _, workers := range []int{1, 3} {
+		if err := NewChain(2).ReadFiles(paths, workers); err == nil {
+			t.Errorf("-j %d: reading a missing file succeeded", workers)
+		}
+	}
+}
+
+func BenchmarkReadFiles(b *testing.B) {
+	paths := writeCorpora(b, b.TempDir(), 16, 50000)
+	var size int64
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += fi.Size()
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("j%d", workers), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if err := NewChain(2).ReadFiles(paths, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
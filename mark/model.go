@@ -0,0 +1,826 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Model file formats understood by WriteModel and ReadModel.
+//
+// The text format is the original one: the first line holds the prefix
+// length and every other line holds the words of a prefix followed by pairs
+// of suffix and frequency, with "" standing for the empty word. It cannot
+// represent words containing whitespace or the literal word "".
+// Models that the original layout cannot describe, such as backoff models
+// or models holding such words, are written in version 2 of the text format instead: a "#mark-model"
+// header line of key=value settings, then one line per prefix with the
+// prefix words and the suffix pairs separated by a tab, and every word
+// escaped by escapeWord.
+//
+// The json and gob formats start with a header carrying the format version
+// and store every prefix as an array of words, so any word survives a round
+// trip.
+//
+// The index format, described in index.go, is binary and laid out to be
+// memory-mapped by ReadModelFile and queried without reading it whole.
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatGob   = "gob"
+	formatIndex = "index"
+)
+
+// modelVersion is the version written in the header of json, gob and
+// version 2 text models. Version 2 added MinOrder, version 3 Tokenizer.
+const modelVersion = 3
+
+// textMagic starts the header line of a version 2 text model.
+const textMagic = "#mark-model"
+
+// gobMagic starts every gob model so that ReadModel can recognise it.
+const gobMagic = "MARKGOB\n"
+
+// modelHeader is the first record of a json or gob model.
+type modelHeader struct {
+	Format    string `json:"format"` // always "mark"
+	Version   int    `json:"version"`
+	PrefixLen int    `json:"prefixLen"`
+	MinOrder  int    `json:"minOrder,omitempty"`  // 0 means PrefixLen
+	Tokenizer string `json:"tokenizer,omitempty"` // "" means defaultTokenizer
+}
+
+// modelEntry is a prefix of a model together with its suffixes.
+type modelEntry struct {
+	Prefix   Prefix        `json:"prefix"`
+	Suffixes []suffixCount `json:"suffixes"`
+}
+
+// suffixCount is a suffix and the number of times it followed a prefix.
+type suffixCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+// modelSink receives a model as it is decoded: begin is called once with
+// the checked header, then add is called for every prefix in file order.
+type modelSink interface {
+	begin(h modelHeader)
+	add(e modelEntry)
+}
+
+// validFormat reports whether format names a model file format.
+func validFormat(format string) bool {
+	return format == formatText || format == formatJSON || format == formatGob ||
+		format == formatIndex
+}
+
+// header returns the header describing c.
+func (c *Chain) header() modelHeader {
+	return modelHeader{"mark", modelVersion, c.prefixLen, c.minOrder, c.tokenizer}
+}
+
+// entries returns the prefixes of c with their suffix frequencies.
+func (c *Chain) entries() []modelEntry {
+	es := make([]modelEntry, 0, len(c.chain))
+	for k, v := range c.chain {
+		e := modelEntry{Prefix: splitKey(k)}
+		for word, count := range v {
+			e.Suffixes = append(e.Suffixes, suffixCount{word, count})
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// comparePrefix compares two prefixes word by word and returns -1, 0 or +1.
+func comparePrefix(a, b Prefix) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// sortEntries puts es in canonical order: prefixes sorted word by word and
+// the suffixes of each prefix sorted by word.
+func sortEntries(es []modelEntry) {
+	sort.Slice(es, func(i, j int) bool {
+		return comparePrefix(es[i].Prefix, es[j].Prefix) < 0
+	})
+	for _, e := range es {
+		s := e.Suffixes
+		sort.Slice(s, func(i, j int) bool { return s[i].Word < s[j].Word })
+	}
+}
+
+// encodeModel writes c to w in the given format. A canonical model has its
+// entries sorted, so that equal chains are written as identical files.
+func encodeModel(w io.Writer, c *Chain, format string, canonical bool) error {
+	es := c.entries()
+	if canonical {
+		sortEntries(es)
+	}
+	return encodeEntries(w, c.header(), es, format)
+}
+
+// writeModelFile writes a model to the named file with encode. The model
+// goes to a temporary file in the same directory, which is renamed over
+// name once it is complete: a reader never sees a model half written, and
+// a server that has the old model mapped keeps reading the old file.
+func writeModelFile(name string, encode func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = encode(f); err != nil {
+		err = fmt.Errorf("writing %s: %w", name, err)
+	} else {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// encodeEntries writes the model with header h and entries es to w in the
+// given format.
+func encodeEntries(w io.Writer, h modelHeader, es []modelEntry, format string) error {
+	switch format {
+	case formatText:
+		if h.MinOrder != h.PrefixLen || h.Tokenizer != defaultTokenizer || !plainWords(es) {
+			return encodeTextV2(w, h, es)
+		}
+		return encodeText(w, h, es)
+	case formatJSON:
+		return encodeJSON(w, h, es)
+	case formatGob:
+		return encodeGob(w, h, es)
+	case formatIndex:
+		return encodeIndex(w, h, es)
+	}
+	return fmt.Errorf("unknown model format %q", format)
+}
+
+// escapeWord makes word safe to write to a version 2 text model: the
+// empty word becomes \0, and backslashes and white space are escaped.
+func escapeWord(word string) string {
+	if word == "" {
+		return `\0`
+	}
+	if !strings.ContainsFunc(word, func(r rune) bool { return r == '\\' || unicode.IsSpace(r) }) {
+		return word
+	}
+	var b strings.Builder
+	for _, r := range word {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == ' ':
+			b.WriteString(`\s`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case unicode.IsSpace(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// unescapeWord reverses escapeWord.
+func unescapeWord(word string) (string, error) {
+	if word == `\0` {
+		return "", nil
+	}
+	if !strings.Contains(word, `\`) {
+		return word, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(word); i++ {
+		if word[i] != '\\' {
+			b.WriteByte(word[i])
+			continue
+		}
+		if i+1 == len(word) {
+			return "", fmt.Errorf("bad escape in %q", word)
+		}
+		i++
+		switch word[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 's':
+			b.WriteByte(' ')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'u':
+			if i+5 > len(word) {
+				return "", fmt.Errorf("bad escape in %q", word)
+			}
+			r, err := strconv.ParseUint(word[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("bad escape in %q", word)
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			return "", fmt.Errorf("bad escape in %q", word)
+		}
+	}
+	return b.String(), nil
+}
+
+// plainWords reports whether the original text format can hold the words
+// of es: none may contain white space or be the literal word "", which
+// stands for the empty word there, and only prefixes may hold the empty
+// word.
+func plainWords(es []modelEntry) bool {
+	plain := func(word string) bool {
+		return word != `""` && !strings.ContainsFunc(word, unicode.IsSpace)
+	}
+	for _, e := range es {
+		for _, word := range e.Prefix {
+			if !plain(word) {
+				return false
+			}
+		}
+		for _, s := range e.Suffixes {
+			if s.Word == "" || !plain(s.Word) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func encodeText(w io.Writer, h modelHeader, es []modelEntry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, h.PrefixLen)
+	for _, e := range es {
+		for _, word := range e.Prefix {
+			if word == "" { // the empty word is written as ""
+				word = "\"\""
+			}
+			bw.WriteString(word + " ")
+		}
+		for _, s := range e.Suffixes {
+			bw.WriteString(s.Word + " " + strconv.Itoa(s.Count) + " ")
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+func encodeTextV2(w io.Writer, h modelHeader, es []modelEntry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s version=%d prefixLen=%d minOrder=%d tokenizer=%s\n",
+		textMagic, h.Version, h.PrefixLen, h.MinOrder, h.Tokenizer)
+	for _, e := range es {
+		for i, word := range e.Prefix {
+			if i > 0 {
+				bw.WriteString(" ")
+			}
+			bw.WriteString(escapeWord(word))
+		}
+		bw.WriteString("\t")
+		for i, s := range e.Suffixes {
+			if i > 0 {
+				bw.WriteString(" ")
+			}
+			bw.WriteString(escapeWord(s.Word) + " " + strconv.Itoa(s.Count))
+		}
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+func encodeJSON(w io.Writer, h modelHeader, es []modelEntry) error {
+	bw := bufio.NewWriter(w)
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	// Write the header fields first and one entry per line, so that the
+	// file can be decoded as a stream and still diffs line by line.
+	bw.Write(hb[:len(hb)-1])
+	bw.WriteString(",\"entries\":[")
+	for i, e := range es {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n")
+		bw.Write(b)
+	}
+	bw.WriteString("\n]}\n")
+	return bw.Flush()
+}
+
+func encodeGob(w io.Writer, h modelHeader, es []modelEntry) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(gobMagic)
+	enc := gob.NewEncoder(bw)
+	if err := enc.Encode(h); err != nil {
+		return err
+	}
+	for _, e := range es {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// detectFormat returns the format of the model read by br without
+// consuming any of it.
+func detectFormat(br *bufio.Reader) string {
+	if b, _ := br.Peek(len(gobMagic)); string(b) == gobMagic {
+		return formatGob
+	}
+	if b, _ := br.Peek(len(indexMagic)); string(b) == indexMagic {
+		return formatIndex
+	}
+	for i := 1; ; i++ {
+		b, err := br.Peek(i)
+		if err != nil || len(b) < i {
+			return formatText
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return formatJSON
+		}
+		return formatText
+	}
+}
+
+// decodeModel detects the format of the model read from r and feeds it to
+// sink. It returns the detected format.
+func decodeModel(r io.Reader, sink modelSink) (string, error) {
+	br := bufio.NewReader(r)
+	format := detectFormat(br)
+	var err error
+	switch format {
+	case formatText:
+		err = decodeText(br, sink)
+	case formatJSON:
+		err = decodeJSON(br, sink)
+	case formatGob:
+		err = decodeGob(br, sink)
+	case formatIndex:
+		err = decodeIndex(br, sink)
+	}
+	return format, err
+}
+
+// A ModelError is a malformed model file, with the position of the problem.
+// Line and Col count from 1, Col in bytes; Col is 0 when only the line is
+// known, and both are 0 for gob and index models, which have no lines.
+type ModelError struct {
+	Line, Col int
+	Err       error
+}
+
+func (e *ModelError) Error() string {
+	switch {
+	case e.Line == 0:
+		return e.Err.Error()
+	case e.Col == 0:
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Col, e.Err)
+}
+
+func (e *ModelError) Unwrap() error { return e.Err }
+
+// modelErrorf returns a ModelError at line and col.
+func modelErrorf(line, col int, format string, args ...interface{}) error {
+	return &ModelError{line, col, fmt.Errorf(format, args...)}
+}
+
+// fieldsAt splits s around white space like strings.Fields, and also
+// returns the column, counted in bytes from 1, at which every field starts.
+func fieldsAt(s string) ([]string, []int) {
+	var fields []string
+	var cols []int
+	start := -1
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				cols = append(cols, start+1)
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+		cols = append(cols, start+1)
+	}
+	return fields, cols
+}
+
+// parseCount parses the suffix count field found at line and col.
+func parseCount(field string, line, col int) (int, error) {
+	frequency, err := strconv.Atoi(field)
+	if err != nil || frequency < 1 {
+		return 0, modelErrorf(line, col, "bad frequency %q", field)
+	}
+	return frequency, nil
+}
+
+func decodeText(br *bufio.Reader, sink modelSink) error {
+	line, err := br.ReadString('\n')
+	if err != nil && line == "" {
+		if err == io.EOF {
+			return modelErrorf(1, 1, "missing prefix length")
+		}
+		return err
+	}
+	if strings.HasPrefix(line, textMagic) {
+		return decodeTextV2(br, line, sink)
+	}
+	prefixLen, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || prefixLen < 1 {
+		return modelErrorf(1, 1, "prefix length should be an integer >= 1")
+	}
+	sink.begin(modelHeader{"mark", 1, prefixLen, prefixLen, defaultTokenizer})
+
+	for lineno := 2; ; lineno++ {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		splited, cols := fieldsAt(line) // split the line, get a slice of words
+		if len(splited) == 0 {
+			continue
+		}
+		if len(splited) < prefixLen {
+			return modelErrorf(lineno, len(line)+1, "malformed entry: want %d prefix words,"+
+				" found %d", prefixLen, len(splited))
+		}
+		if len(splited) == prefixLen {
+			return modelErrorf(lineno, len(line)+1, "malformed entry: prefix has no suffixes")
+		}
+		if (len(splited)-prefixLen)%2 != 0 {
+			last := len(splited) - 1
+			return modelErrorf(lineno, cols[last], "malformed entry: suffix %q has no count",
+				splited[last])
+		}
+
+		e := modelEntry{Prefix: make(Prefix, prefixLen)}
+		copy(e.Prefix, splited[:prefixLen])
+		// replace all \"\" with empty string
+		for i, word := range e.Prefix {
+			if word == "\"\"" {
+				e.Prefix[i] = ""
+			}
+		}
+		for i := prefixLen; i < len(splited); i += 2 {
+			frequency, err := parseCount(splited[i+1], lineno, cols[i+1])
+			if err != nil {
+				return err
+			}
+			e.Suffixes = append(e.Suffixes, suffixCount{splited[i], frequency})
+		}
+		sink.add(e)
+	}
+}
+
+// decodeTextV2 decodes a version 2 text model whose header line has
+// already been read.
+func decodeTextV2(br *bufio.Reader, header string, sink modelSink) error {
+	h := modelHeader{Format: "mark"}
+	fields, cols := fieldsAt(header)
+	for i, field := range fields[1:] {
+		col := cols[i+1]
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return modelErrorf(1, col, "malformed setting %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "version":
+			h.Version, err = strconv.Atoi(kv[1])
+		case "prefixLen":
+			h.PrefixLen, err = strconv.Atoi(kv[1])
+		case "minOrder":
+			h.MinOrder, err = strconv.Atoi(kv[1])
+		case "tokenizer":
+			h.Tokenizer = kv[1]
+		default:
+			return modelErrorf(1, col, "unknown setting %q", kv[0])
+		}
+		if err != nil {
+			return modelErrorf(1, col+len(kv[0])+1, "%s should be an integer", kv[0])
+		}
+	}
+	if err := checkHeader(&h); err != nil {
+		return &ModelError{1, 0, err}
+	}
+	sink.begin(h)
+
+	for lineno := 2; ; lineno++ {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return modelErrorf(lineno, len(line)+1, "missing tab after prefix")
+		}
+		var e modelEntry
+		words, cols := fieldsAt(line[:tab])
+		for i, word := range words {
+			word, err := unescapeWord(word)
+			if err != nil {
+				return &ModelError{lineno, cols[i], err}
+			}
+			e.Prefix = append(e.Prefix, word)
+		}
+		pairs, cols := fieldsAt(line[tab+1:])
+		for i := range cols {
+			cols[i] += tab + 1
+		}
+		if len(pairs)%2 != 0 {
+			last := len(pairs) - 1
+			return modelErrorf(lineno, cols[last], "malformed entry: suffix %q has no count",
+				pairs[last])
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			word, err := unescapeWord(pairs[i])
+			if err != nil {
+				return &ModelError{lineno, cols[i], err}
+			}
+			frequency, err := parseCount(pairs[i+1], lineno, cols[i+1])
+			if err != nil {
+				return err
+			}
+			e.Suffixes = append(e.Suffixes, suffixCount{word, frequency})
+		}
+		if err := checkEntry(h, e); err != nil {
+			return &ModelError{lineno, 1, err}
+		}
+		sink.add(e)
+	}
+}
+
+// checkHeader verifies that h describes a model this program can read and
+// fills in the defaults of older versions.
+func checkHeader(h *modelHeader) error {
+	if h.Format != "mark" {
+		return fmt.Errorf("not a mark model")
+	}
+	if h.Version < 1 || h.Version > modelVersion {
+		return fmt.Errorf("unsupported model version %d", h.Version)
+	}
+	if h.PrefixLen < 1 {
+		return fmt.Errorf("prefix length should be an integer >= 1")
+	}
+	if h.MinOrder == 0 {
+		h.MinOrder = h.PrefixLen
+	}
+	if h.MinOrder < 1 || h.MinOrder > h.PrefixLen {
+		return fmt.Errorf("minimum order should be between 1 and the prefix length")
+	}
+	if h.Tokenizer == "" {
+		h.Tokenizer = defaultTokenizer
+	}
+	if _, ok := tokenizers[h.Tokenizer]; !ok {
+		return fmt.Errorf("unknown tokenizer %q", h.Tokenizer)
+	}
+	return nil
+}
+
+// checkEntry verifies that the prefix of e has a length allowed by h and
+// at least one suffix, each seen at least once.
+func checkEntry(h modelHeader, e modelEntry) error {
+	if len(e.Prefix) < h.MinOrder || len(e.Prefix) > h.PrefixLen {
+		return fmt.Errorf("prefix [%s] should have %d to %d words",
+			e.Prefix.display(), h.MinOrder, h.PrefixLen)
+	}
+	if len(e.Suffixes) == 0 {
+		// Generation would stop at such a prefix, though the chain
+		// seems to know it.
+		return fmt.Errorf("prefix [%s] has no suffixes", e.Prefix.display())
+	}
+	for _, s := range e.Suffixes {
+		if s.Count < 1 {
+			return fmt.Errorf("suffix %q of prefix [%s] has count %d, should be >= 1",
+				s.Word, e.Prefix.display(), s.Count)
+		}
+	}
+	return nil
+}
+
+// lineIndex passes on what it reads from r and records where every line
+// starts, so that the byte offsets reported by a json.Decoder can be turned
+// into lines and columns. It keeps one offset per line read.
+type lineIndex struct {
+	r      io.Reader
+	n      int64   // bytes read so far
+	starts []int64 // offsets of the second and following lines
+}
+
+func (l *lineIndex) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			l.starts = append(l.starts, l.n+int64(i)+1)
+		}
+	}
+	l.n += int64(n)
+	return n, err
+}
+
+// errorAt returns err as a ModelError at offset off, or at the offset the
+// error itself reports when json found it.
+func (l *lineIndex) errorAt(off int64, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		off = e.Offset
+	case *json.UnmarshalTypeError:
+		off = e.Offset
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	line := sort.Search(len(l.starts), func(i int) bool { return l.starts[i] > off })
+	start := int64(0)
+	if line > 0 {
+		start = l.starts[line-1]
+	}
+	return &ModelError{line + 1, int(off-start) + 1, err}
+}
+
+func decodeJSON(br *bufio.Reader, sink modelSink) error {
+	li := &lineIndex{r: br}
+	dec := json.NewDecoder(li)
+	if err := expectDelim(dec, '{'); err != nil {
+		return li.errorAt(dec.InputOffset(), err)
+	}
+	var h modelHeader
+	begun := false
+	for dec.More() {
+		off := dec.InputOffset()
+		t, err := dec.Token()
+		if err != nil {
+			return li.errorAt(off, err)
+		}
+		switch t {
+		case "format":
+			err = dec.Decode(&h.Format)
+		case "version":
+			err = dec.Decode(&h.Version)
+		case "prefixLen":
+			err = dec.Decode(&h.PrefixLen)
+		case "minOrder":
+			err = dec.Decode(&h.MinOrder)
+		case "tokenizer":
+			err = dec.Decode(&h.Tokenizer)
+		case "entries":
+			if err := checkHeader(&h); err != nil {
+				return li.errorAt(off, err)
+			}
+			sink.begin(h)
+			begun = true
+			if err := expectDelim(dec, '['); err != nil {
+				return li.errorAt(dec.InputOffset(), err)
+			}
+			for dec.More() {
+				// Decode reports type errors at offsets within the
+				// value, so take the value whole and decode it apart.
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return li.errorAt(dec.InputOffset(), err)
+				}
+				start := dec.InputOffset() - int64(len(raw))
+				var e modelEntry
+				if err := json.Unmarshal(raw, &e); err != nil {
+					if te, ok := err.(*json.UnmarshalTypeError); ok {
+						te.Offset += start
+					}
+					return li.errorAt(start, err)
+				}
+				if err := checkEntry(h, e); err != nil {
+					// The entry ends on the line it starts on when
+					// written by encodeJSON; report the line only.
+					me := li.errorAt(dec.InputOffset()-1, err).(*ModelError)
+					me.Col = 0
+					return me
+				}
+				sink.add(e)
+			}
+			err = expectDelim(dec, ']')
+		default:
+			return li.errorAt(off, fmt.Errorf("unknown field %v", t))
+		}
+		if err != nil {
+			return li.errorAt(dec.InputOffset(), err)
+		}
+	}
+	if !begun {
+		return li.errorAt(dec.InputOffset(), fmt.Errorf("missing entries"))
+	}
+	return nil
+}
+
+// expectDelim reads the next token of dec and checks that it is delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("expected %v, found %v", delim, t)
+	}
+	return nil
+}
+
+func decodeGob(br *bufio.Reader, sink modelSink) error {
+	magic := make([]byte, len(gobMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, []byte(gobMagic)) {
+		return modelErrorf(0, 0, "not a gob model")
+	}
+	dec := gob.NewDecoder(br)
+	var h modelHeader
+	if err := dec.Decode(&h); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return modelErrorf(0, 0, "header: %w", err)
+	}
+	if err := checkHeader(&h); err != nil {
+		return &ModelError{0, 0, err}
+	}
+	sink.begin(h)
+	for n := 1; ; n++ {
+		var e modelEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return modelErrorf(0, 0, "entry %d: %w", n, err)
+		}
+		if err := checkEntry(h, e); err != nil {
+			return modelErrorf(0, 0, "entry %d: %w", n, err)
+		}
+		sink.add(e)
+	}
+}
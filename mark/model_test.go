@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	testHeader = modelHeader{"mark", modelVersion, 2, 2, defaultTokenizer}
+	testEntry  = modelEntry{Prefix{"a", "b"}, []suffixCount{{"c", 2}, {"d", 1}}}
+)
+
+// encoded returns the model with header h and entries es in the given
+// format, without the checks decoding makes.
+func encoded(t *testing.T, format string, h modelHeader, es ...modelEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeEntries(&buf, h, es, format); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// indexWithHeader returns an empty index model whose header is the given
+// JSON.
+func indexWithHeader(header string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(indexMagic)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(header)))
+	buf.WriteString(header)
+	buf.Write(make([]byte, 32))
+	return buf.Bytes()
+}
+
+func TestCorruptModels(t *testing.T) {
+	v2 := "#mark-model version=3 prefixLen=2 minOrder=1 tokenizer=whitespace\n"
+	json := encoded(t, formatJSON, testHeader, testEntry)
+	gob := encoded(t, formatGob, testHeader, testEntry)
+	index := encoded(t, formatIndex, testHeader, testEntry)
+	for _, tc := range []struct {
+		name      string
+		model     []byte
+		line, col int
+		err       string // part of the error message
+	}{
+		{"text/empty", []byte(""), 1, 1, "missing prefix length"},
+		{"text/prefix length", []byte("two\n"), 1, 1, "prefix length"},
+		{"text/missing count", []byte("2\na b c\n"), 2, 5, `suffix "c" has no count`},
+		{"text/bad frequency", []byte("2\na b c x\n"), 2, 7, `bad frequency "x"`},
+		{"text/zero frequency", []byte("2\na b c 1 d 0\n"), 2, 11, `bad frequency "0"`},
+		{"text/negative frequency", []byte("2\n\na b c -3\n"), 3, 7, `bad frequency "-3"`},
+		{"text/short prefix", []byte("2\na\n"), 2, 3, "want 2 prefix words, found 1"},
+		{"text/no suffixes", []byte("2\n\"\" \"\" a 1\n\"\" a b 2\na b\n"), 4, 5,
+			"prefix has no suffixes"},
+
+		{"v2/unknown setting", []byte("#mark-model version=3 prefixLen=2 colour=red\n"),
+			1, 35, `unknown setting "colour"`},
+		{"v2/malformed setting", []byte("#mark-model version=3 prefixLen\n"),
+			1, 23, `malformed setting "prefixLen"`},
+		{"v2/bad setting", []byte("#mark-model version=3 prefixLen=x\n"),
+			1, 33, "prefixLen should be an integer"},
+		{"v2/version", []byte("#mark-model version=9 prefixLen=2\n"),
+			1, 0, "unsupported model version 9"},
+		{"v2/missing tab", []byte(v2 + "a b c 1\n"), 2, 8, "missing tab"},
+		{"v2/long prefix", []byte(v2 + "a b c\tx 1\n"), 2, 1, "should have 1 to 2 words"},
+		{"v2/missing count", []byte(v2 + "a b\tc 1 d\n"), 2, 9, `suffix "d" has no count`},
+		{"v2/bad frequency", []byte(v2 + "a\tc 1\na b\tc q\n"), 3, 7, `bad frequency "q"`},
+		{"v2/no suffixes", []byte(v2 + "a\tc 1\na b\t\n"), 3, 1, "prefix [a b] has no suffixes"},
+		{"v2/bad escape", []byte(v2 + `a\q b` + "\tc 1\n"), 2, 1, "bad escape"},
+
+		{"json/unknown field", []byte(`{"format":"mark","colour":1}`), 1, 17,
+			"unknown field colour"},
+		{"json/missing entries", []byte(`{"format":"mark","version":3,"prefixLen":2}`),
+			1, 43, "missing entries"},
+		{"json/version", []byte(`{"format":"mark","version":0,"prefixLen":2,"entries":[]}`),
+			1, 43, "unsupported model version 0"},
+		{"json/zero count", encoded(t, formatJSON, testHeader,
+			testEntry, modelEntry{Prefix{"b", "c"}, []suffixCount{{"d", 0}}}),
+			3, 0, "has count 0"},
+		{"json/short prefix", encoded(t, formatJSON, testHeader,
+			modelEntry{Prefix{"b"}, []suffixCount{{"d", 1}}}),
+			2, 0, "should have 2 to 2 words"},
+		{"json/no suffixes", encoded(t, formatJSON, testHeader, testEntry,
+			modelEntry{Prefix{"b", "c"}, nil}), 3, 0, "prefix [b c] has no suffixes"},
+		{"json/count type", bytes.Replace(json, []byte(`"count":2`), []byte(`"count":"2"`), 1),
+			2, 56, "cannot unmarshal string"}, // just after the value
+		{"json/truncated", json[:len(json)-20], 2, 1, "unexpected EOF"},
+
+		{"gob/zero count", encoded(t, formatGob, testHeader,
+			testEntry, modelEntry{Prefix{"b", "c"}, []suffixCount{{"d", 0}}}),
+			0, 0, "entry 2: suffix \"d\" of prefix [b c] has count 0"},
+		{"gob/long prefix", encoded(t, formatGob, testHeader,
+			modelEntry{Prefix{"a", "b", "c"}, []suffixCount{{"d", 1}}}),
+			0, 0, "entry 1: prefix [a b c] should have 2 to 2 words"},
+		{"gob/no suffixes", encoded(t, formatGob, testHeader, testEntry,
+			modelEntry{Prefix{"b", "c"}, nil}), 0, 0, "entry 2: prefix [b c] has no suffixes"},
+		{"gob/version", encoded(t, formatGob,
+			modelHeader{"mark", modelVersion + 1, 2, 2, defaultTokenizer}),
+			0, 0, "unsupported model version"},
+		{"gob/truncated entry", gob[:len(gob)-3], 0, 0, "entry 1: unexpected EOF"},
+		{"gob/truncated header", gob[:len(gobMagic)+4], 0, 0, "header: unexpected EOF"},
+
+		{"index/zero count", encoded(t, formatIndex, testHeader,
+			modelEntry{Prefix{"a", "b"}, []suffixCount{{"c", 1}, {"d", 0}}}),
+			0, 0, "prefix 1: corrupt record"},
+		{"index/long prefix", encoded(t, formatIndex, testHeader,
+			modelEntry{Prefix{"a", "b", "c"}, []suffixCount{{"d", 1}}}),
+			0, 0, "prefix 1: prefix [a b c] should have 2 to 2 words"},
+		{"index/no suffixes", encoded(t, formatIndex, testHeader, testEntry,
+			modelEntry{Prefix{"b", "c"}, nil}), 0, 0, "prefix 2: prefix [b c] has no suffixes"},
+		{"index/unknown field",
+			indexWithHeader(`{"format":"mark","version":3,"prefixLen":2,"colour":1}`),
+			0, 0, `unknown field "colour"`},
+		{"index/version",
+			indexWithHeader(`{"format":"mark","version":99,"prefixLen":2}`),
+			0, 0, "unsupported model version 99"},
+		{"index/truncated", index[:len(index)-1], 0, 0, "truncated"},
+		{"index/trailing data", append(index[:len(index):len(index)], 0), 0, 0, "trailing data"},
+		{"index/truncated header", index[:len(indexMagic)+2], 0, 0, "truncated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := ReadChain(bytes.NewReader(tc.model))
+			var me *ModelError
+			if !errors.As(err, &me) {
+				t.Fatalf("got error %v, want a *ModelError", err)
+			}
+			if me.Line != tc.line || me.Col != tc.col {
+				t.Errorf("error at line %d, column %d, want line %d, column %d: %v",
+					me.Line, me.Col, tc.line, tc.col, err)
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error %q does not mention %q", err, tc.err)
+			}
+		})
+	}
+}
+
+// TestValidModels checks that the fixtures above are corrupt only where
+// they were made so.
+func TestValidModels(t *testing.T) {
+	for _, format := range []string{formatText, formatJSON, formatGob, formatIndex} {
+		c, got, err := ReadChain(bytes.NewReader(encoded(t, format, testHeader, testEntry)))
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if got != format {
+			t.Errorf("%s model detected as %s", format, got)
+		}
+		if n := c.chain["a b"]["c"]; n != 2 {
+			t.Errorf("%s: count of [a b] c is %d, want 2", format, n)
+		}
+	}
+}
+
+// TestModelRoundTrip checks that every format reads back the words it was
+// given, white space, backslashes and the literal word "" included, in
+// prefixes and suffixes alike.
+func TestModelRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		chain map[string]map[string]int
+		v1    bool // whether the text format can stay at version 1
+	}{
+		{"plain", map[string]map[string]int{
+			Prefix{"", ""}.String():   {"a": 1},
+			Prefix{"", "a"}.String():  {"b": 1},
+			Prefix{"a", "b"}.String(): {"c": 2, "#d": 1, `back\slash`: 1},
+		}, true},
+		{"literal quotes", map[string]map[string]int{
+			Prefix{"", `""`}.String():   {`""`: 3},
+			Prefix{`""`, `""`}.String(): {"x": 1},
+		}, false},
+		{"empty suffix", map[string]map[string]int{
+			Prefix{"a", "b"}.String(): {"": 1, "c": 1},
+		}, false},
+		{"space", map[string]map[string]int{
+			Prefix{"new york", "b"}.String():  {"san francisco": 2, " ": 1},
+			Prefix{"a", "trailing "}.String(): {" leading": 1},
+		}, false},
+		{"tab", map[string]map[string]int{
+			Prefix{"a\tb", "c"}.String(): {"\t": 1, "d\t": 4},
+		}, false},
+		{"newline", map[string]map[string]int{
+			Prefix{"line\nbreak", "\r\n"}.String(): {"\n": 1, "x\ry": 2},
+		}, false},
+		{"backslash", map[string]map[string]int{
+			Prefix{`a\`, `\n`}.String(): {`\t`: 1, `\\`: 2, `\ `: 1, "\\\n": 1},
+			Prefix{`\s`, `\`}.String():  {`\`: 5},
+		}, false},
+		{"unicode space", map[string]map[string]int{
+			Prefix{"a\u00a0b", "c\u2003"}.String(): {"\u3000": 1},
+		}, false},
+	} {
+		for _, format := range []string{formatText, formatJSON, formatGob, formatIndex} {
+			t.Run(tc.name+"/"+format, func(t *testing.T) {
+				c := NewChain(2)
+				c.chain = tc.chain
+				var buf bytes.Buffer
+				if err := encodeModel(&buf, c, format, true); err != nil {
+					t.Fatal(err)
+				}
+				if format == formatText {
+					if v1 := !bytes.HasPrefix(buf.Bytes(), []byte(textMagic)); v1 != tc.v1 {
+						t.Errorf("written as version 1: %v, want %v", v1, tc.v1)
+					}
+				}
+				got, _, err := ReadChain(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got.chain, tc.chain) {
+					t.Errorf("read back %#v, want %#v", got.chain, tc.chain)
+				}
+			})
+		}
+	}
+}
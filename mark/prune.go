@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// PruneStats counts what a Chain held before and after Prune.
+type PruneStats struct {
+	PrefixesBefore, PrefixesAfter int
+	SuffixesBefore, SuffixesAfter int // distinct prefix and suffix pairs
+	CountBefore, CountAfter       int // observations
+}
+
+// Prune removes rare transitions from c: suffixes seen fewer than minCount
+// times after a prefix, then all but the top most frequent suffixes of every
+// prefix if top is positive, and finally prefixes left with fewer than
+// minTotal observations. The empty prefix, where generation starts, is
+// seen only once per input and is kept whole.
+func (c *Chain) Prune(minCount, minTotal, top int) PruneStats {
+	var st PruneStats
+	st.PrefixesBefore = len(c.chain)
+	for key, tf := range c.chain {
+		st.SuffixesBefore += len(tf)
+		st.CountBefore += total(tf)
+		if isEmptyPrefix(splitKey(key)) {
+			st.SuffixesAfter += len(tf)
+			st.CountAfter += total(tf)
+			continue
+		}
+
+		for word, count := range tf {
+			if count < minCount {
+				delete(tf, word)
+			}
+		}
+		if top > 0 && len(tf) > top {
+			words := make([]string, 0, len(tf))
+			for word := range tf {
+				words = append(words, word)
+			}
+			// Most frequent first; ties by word, so pruning is repeatable.
+			sort.Slice(words, func(i, j int) bool {
+				if tf[words[i]] != tf[words[j]] {
+					return tf[words[i]] > tf[words[j]]
+				}
+				return words[i] < words[j]
+			})
+			for _, word := range words[top:] {
+				delete(tf, word)
+			}
+		}
+
+		t := total(tf)
+		if len(tf) == 0 || t < minTotal {
+			delete(c.chain, key)
+			continue
+		}
+		st.SuffixesAfter += len(tf)
+		st.CountAfter += t
+	}
+	st.PrefixesAfter = len(c.chain)
+	return st
+}
+
+// isEmptyPrefix reports whether every word of p is empty.
+func isEmptyPrefix(p Prefix) bool {
+	for _, word := range p {
+		if word != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// runPrune writes a smaller copy of a model:
+// mark prune [-min-count c] [-min-total k] [-top m] modelfile outfilename
+func runPrune(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	minCount := flags.Int("min-count", 2, "drop suffixes seen fewer times after a prefix")
+	minTotal := flags.Int("min-total", 1, "drop prefixes left with fewer observations")
+	top := flags.Int("top", 0, "keep only this many most frequent suffixes per prefix (0: all)")
+	format := flags.String("format", "",
+		"model file format: text, json, gob or index (default: that of modelfile)")
+	canonical := flags.Bool("canonical", false,
+		"write prefixes and suffixes in sorted order")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 2 {
+		return usageError("prune command should be: mark prune [-min-count c]" +
+			" [-min-total k] [-top m] [--format=text|json|gob|index] [-canonical]" +
+			" modelfile outfilename")
+	}
+	if *format != "" && !validFormat(*format) {
+		return usageError("format should be text, json, gob or index")
+	}
+
+	c, modelFormat, err := ReadChainFile(args[0])
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = modelFormat
+	}
+	st := c.Prune(*minCount, *minTotal, *top)
+	if err := c.WriteModel(args[1], *format, *canonical); err != nil {
+		return err
+	}
+
+	fmt.Printf("prefixes:      %d -> %d\n", st.PrefixesBefore, st.PrefixesAfter)
+	fmt.Printf("transitions:   %d -> %d\n", st.SuffixesBefore, st.SuffixesAfter)
+	if in, err := os.Stat(args[0]); err == nil {
+		if out, err := os.Stat(args[1]); err == nil {
+			fmt.Printf("file size:     %d -> %d bytes (%.1f%% smaller)\n", in.Size(),
+				out.Size(), 100*(1-float64(out.Size())/float64(in.Size())))
+		}
+	}
+	if st.CountBefore > 0 {
+		fmt.Printf("coverage lost: %.2f%% of observations\n",
+			100*(1-float64(st.CountAfter)/float64(st.CountBefore)))
+	}
+	return nil
+}
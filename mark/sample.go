@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Sampling reshapes the suffix distribution of every prefix before a
+// suffix is drawn. The zero value draws suffixes in proportion to their
+// counts, exactly as suffixes.pick does.
+type Sampling struct {
+	// Temperature raises every count to the power 1/Temperature: above 1
+	// flattens the distribution, below 1 sharpens it. 0 means 1; the
+	// limit of a temperature going to 0 is Greedy.
+	Temperature float64
+	// TopK keeps only the TopK most frequent suffixes. 0 keeps all.
+	TopK int
+	// TopP keeps the fewest most frequent suffixes whose probabilities,
+	// after Temperature, add up to at least TopP. 0 means 1.
+	TopP float64
+	// Greedy always draws the most frequent suffix, the first in the
+	// model among equally frequent ones.
+	Greedy bool
+}
+
+// newSampling returns the Sampling for the command line and HTTP
+// parameters of the same names, where a temperature of 0 means greedy.
+func newSampling(temperature float64, topK int, topP float64) Sampling {
+	return Sampling{Temperature: temperature, TopK: topK, TopP: topP,
+		Greedy: temperature == 0}
+}
+
+// validSampling reports whether newSampling accepts its parameters:
+// temperature and topK >= 0 and topP between 0 and 1, none of them NaN or
+// infinite.
+func validSampling(temperature float64, topK int, topP float64) bool {
+	for _, x := range []float64{temperature, topP} {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return temperature >= 0 && topK >= 0 && topP >= 0 && topP <= 1
+}
+
+// plain reports whether sm leaves the distribution unchanged.
+func (sm Sampling) plain() bool {
+	return (sm.Temperature == 0 || sm.Temperature == 1) && sm.TopK == 0 &&
+		(sm.TopP == 0 || sm.TopP >= 1) && !sm.Greedy
+}
+
+// decoded returns s with its words and counts in memory, reading them
+// from a mapped index model if need be. It returns nil if the record in
+// the index is corrupt.
+func (s *suffixes) decoded() *suffixes {
+	if s.index == nil {
+		return s
+	}
+	return s.index.entry(s.rec)
+}
+
+// count returns the frequency of words[i].
+func (s *suffixes) count(i int) int {
+	if i == 0 {
+		return s.cum[0]
+	}
+	return s.cum[i] - s.cum[i-1]
+}
+
+// without returns the suffixes of s other than words, or nil if there are
+// none. It returns s itself if words is empty.
+func (s *suffixes) without(words []string) *suffixes {
+	if len(words) == 0 {
+		return s
+	}
+	if s = s.decoded(); s == nil {
+		return nil
+	}
+	t := new(suffixes)
+outer:
+	for i, word := range s.words {
+		for _, w := range words {
+			if w == word {
+				continue outer
+			}
+		}
+		t.add(word, s.count(i))
+	}
+	if len(t.words) == 0 {
+		return nil
+	}
+	return t
+}
+
+// sample draws a suffix from rng with the distribution reshaped by sm.
+func (s *suffixes) sample(rng *rand.Rand, sm Sampling) string {
+	if sm.plain() {
+		// Intn returns, as an int, a non-negative pseudo-random number in [0,n)
+		return s.pick(rng.Intn(s.total()))
+	}
+	if s = s.decoded(); s == nil {
+		return ""
+	}
+
+	// Most frequent first; ties keep the model's order.
+	idx := make([]int, len(s.words))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return s.count(idx[a]) > s.count(idx[b]) })
+	if sm.Greedy {
+		return s.words[idx[0]]
+	}
+	if sm.TopK > 0 && sm.TopK < len(idx) {
+		idx = idx[:sm.TopK]
+	}
+
+	// Weigh the counts relative to the largest, so that a low
+	// temperature cannot raise them past the range of a float64.
+	weights := make([]float64, len(idx))
+	sum := 0.0
+	top := float64(s.count(idx[0]))
+	for i, j := range idx {
+		w := float64(s.count(j)) / top
+		if sm.Temperature > 0 && sm.Temperature != 1 {
+			w = math.Pow(w, 1/sm.Temperature)
+		}
+		weights[i] = w
+		sum += w
+	}
+	if sm.TopP > 0 && sm.TopP < 1 {
+		kept := 0.0
+		for i, w := range weights {
+			kept += w
+			if kept >= sm.TopP*sum {
+				weights, sum = weights[:i+1], kept
+				break
+			}
+		}
+	}
+
+	r := rng.Float64() * sum
+	for i, w := range weights {
+		if r < w {
+			return s.words[idx[i]]
+		}
+		r -= w
+	}
+	return s.words[idx[len(weights)-1]] // rounding left r just above the last weight
+}
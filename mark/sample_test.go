@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidSampling(t *testing.T) {
+	for _, tc := range []struct {
+		temperature float64
+		topK        int
+		topP        float64
+		want        bool
+	}{
+		{1, 0, 1, true},
+		{0, 0, 0, true},
+		{0.01, 5, 0.9, true},
+		{-1, 0, 1, false},
+		{1, -1, 1, false},
+		{1, 0, -0.1, false},
+		{1, 0, 1.1, false},
+		{math.NaN(), 0, 1, false},
+		{math.Inf(1), 0, 1, false},
+		{1, 0, math.NaN(), false},
+		{1, 0, math.Inf(-1), false},
+	} {
+		if got := validSampling(tc.temperature, tc.topK, tc.topP); got != tc.want {
+			t.Errorf("validSampling(%g, %d, %g) = %v, want %v",
+				tc.temperature, tc.topK, tc.topP, got, tc.want)
+		}
+	}
+}
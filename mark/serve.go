@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadedModel is a model served by a server, with what the stats endpoint
+// reports about it.
+type loadedModel struct {
+	c        *ChainForGenerate
+	modTime  time.Time
+	size     int64
+	loadedAt time.Time
+	prefixes int
+	file     os.FileInfo // to tell a replaced file from one changed in place
+
+	// Counting the transitions reads all of an index model, so it is
+	// left to the first stats request.
+	countOnce   sync.Once
+	transitions int
+}
+
+// server answers generation requests from a model file, reloading the
+// model when the file changes. Requests already running keep the model
+// they started with.
+type server struct {
+	modelfile string
+	maxWords  int
+	model     atomic.Pointer[loadedModel]
+
+	// Modification time and size of the model file at the last call of
+	// load, used only by load.
+	seenTime time.Time
+	seenSize int64
+}
+
+// load reads the model file if it changed since the last successful load
+// and makes it the current model. The commands of mark replace a model by
+// renaming a complete new file over it, which load takes at once. A file
+// changed in place is loaded only once its modification time and size
+// have stayed the same between two calls, so that load does not pick up a
+// model half written. A model that fails to load is retried at the next
+// call.
+func (s *server) load() error {
+	fi, err := os.Stat(s.modelfile)
+	if err != nil {
+		return err
+	}
+	cur := s.model.Load()
+	if cur != nil && fi.ModTime().Equal(cur.modTime) && fi.Size() == cur.size {
+		return nil
+	}
+	settled := fi.ModTime().Equal(s.seenTime) && fi.Size() == s.seenSize
+	s.seenTime, s.seenSize = fi.ModTime(), fi.Size()
+	if cur != nil && os.SameFile(fi, cur.file) && !settled {
+		return nil
+	}
+	c, err := ReadModelFile(s.modelfile)
+	if err != nil {
+		return err
+	}
+	m := &loadedModel{c: c, modTime: fi.ModTime(), size: fi.Size(), loadedAt: time.Now(),
+		file: fi}
+	m.prefixes = c.size()
+	s.model.Store(m)
+	log.Printf("mark: loaded %s (%d prefixes)", s.modelfile, m.prefixes)
+	return nil
+}
+
+// watch calls load every interval, logging the models that fail to load.
+func (s *server) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.load(); err != nil {
+			log.Printf("mark: %v", err)
+		}
+	}
+}
+
+// intParam returns the integer query parameter name, or def if it is not
+// given.
+func intParam(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be an integer", name)
+	}
+	return n, nil
+}
+
+// generate answers /generate?n=100&seed=1&start=I+am&sentences=2 with
+// generated text; temperature (0 for greedy), top_k and top_p set the
+// Sampling, and restart=1 and cycle_window=k the options of the same
+// names. All parameters are optional.
+func (s *server) generate(w http.ResponseWriter, r *http.Request) {
+	m := s.model.Load()
+	n, err := intParam(r, "n", 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n < 0 || n > int64(s.maxWords) {
+		http.Error(w, fmt.Sprintf("n should be between 0 and %d", s.maxWords),
+			http.StatusBadRequest)
+		return
+	}
+	seed, err := intParam(r, "seed", rand.Int63())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sentences, err := intParam(r, "sentences", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sentences > 0 && m.c.tokenizer != "sentence" {
+		http.Error(w, "sentences needs a model read with --tokenizer=sentence",
+			http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	temperature, topK, topP := 1.0, 0, 1.0
+	if v := q.Get("temperature"); v != "" {
+		temperature, err = strconv.ParseFloat(v, 64)
+	}
+	if v := q.Get("top_p"); v != "" && err == nil {
+		topP, err = strconv.ParseFloat(v, 64)
+	}
+	if v := q.Get("top_k"); v != "" && err == nil {
+		topK, err = strconv.Atoi(v)
+	}
+	if err != nil || !validSampling(temperature, topK, topP) {
+		http.Error(w, "temperature and top_k should be >= 0, top_p between 0 and 1",
+			http.StatusBadRequest)
+		return
+	}
+	sm := newSampling(temperature, topK, topP)
+
+	restart := q.Get("restart")
+	if restart != "" && restart != "0" && restart != "1" {
+		http.Error(w, "restart should be 0 or 1", http.StatusBadRequest)
+		return
+	}
+	window, err := intParam(r, "cycle_window", 0)
+	if err != nil || window < 0 {
+		http.Error(w, "cycle_window should be an integer >= 0", http.StatusBadRequest)
+		return
+	}
+
+	rng := rand.New(rand.NewSource(seed)) // one source per request
+	opts := StreamOptions{MaxWords: int(n), Sentences: int(sentences), Sampling: sm,
+		Restart: restart == "1", CycleWindow: int(window)}
+	if n == 0 {
+		// Sentences alone would leave Stream unlimited; -max-words
+		// bounds every request.
+		opts.MaxWords = s.maxWords
+	}
+	if start := r.URL.Query().Get("start"); start != "" {
+		var note string
+		opts.Start, note = m.c.StartPrefix(tokenize(m.c.tokenizer, start))
+		if note != "" {
+			w.Header().Set("X-Mark-Note", note)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Mark-Seed", strconv.FormatInt(seed, 10))
+	if n == 0 && sentences == 0 {
+		fmt.Fprintln(w)
+		return
+	}
+	// Stop generating if the client goes away.
+	m.c.Stream(r.Context(), w, rng, opts)
+	fmt.Fprintln(w)
+}
+
+// stats answers /stats with a description of the current model.
+func (s *server) stats(w http.ResponseWriter, r *http.Request) {
+	m := s.model.Load()
+	m.countOnce.Do(func() {
+		m.c.each(func(key string, t int) { m.transitions += t })
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Model       string    `json:"model"`
+		ModTime     time.Time `json:"modTime"`
+		LoadedAt    time.Time `json:"loadedAt"`
+		PrefixLen   int       `json:"prefixLen"`
+		MinOrder    int       `json:"minOrder"`
+		Tokenizer   string    `json:"tokenizer"`
+		Prefixes    int       `json:"prefixes"`
+		Transitions int       `json:"transitions"`
+	}{s.modelfile, m.modTime, m.loadedAt, m.c.prefixLen, m.c.minOrder,
+		m.c.tokenizer, m.prefixes, m.transitions})
+}
+
+// runServe serves generation over HTTP: mark serve -model m.txt -addr :8080
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	modelfile := flags.String("model", "", "model file to serve")
+	addr := flags.String("addr", ":8080", "address to listen on")
+	poll := flags.Duration("poll", 2*time.Second,
+		"how often to check the model file for changes")
+	maxWords := flags.Int("max-words", 100000, "largest n a request may ask for, and the length of a request for sentences without n")
+	flags.Parse(args)
+	if *modelfile == "" || flags.NArg() != 0 {
+		return usageError("serve command should be: mark serve -model modelfile" +
+			" [-addr :8080] [-poll 2s] [-max-words n]")
+	}
+	if *maxWords < 1 {
+		return usageError("max-words should be an integer >= 1")
+	}
+
+	s := &server{modelfile: *modelfile, maxWords: *maxWords}
+	if err := s.load(); err != nil {
+		return err
+	}
+	go s.watch(*poll)
+
+	http.HandleFunc("/generate", s.generate)
+	http.HandleFunc("/stats", s.stats)
+	log.Printf("mark: serving %s on %s", *modelfile, *addr)
+	return http.ListenAndServe(*addr, nil)
+}
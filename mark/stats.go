@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Stats describes the contents of a Chain. In a backoff model the shorter
+// prefixes only stand in for unknown longer ones, so everything but
+// Prefixes and ByOrder is computed over the prefixes of full length.
+type Stats struct {
+	Prefixes        int
+	ByOrder         map[int]int // prefixes of every length
+	Vocabulary      int         // distinct words seen as suffixes
+	Pairs           int         // distinct prefix and suffix pairs
+	Transitions     int         // observations
+	MeanEntropy     float64     // bits per prefix
+	WeightedEntropy float64     // bits per prefix, weighted by observations
+
+	// Branching[i] counts the prefixes followed by n distinct suffixes,
+	// 2^(i-1) < n <= 2^i: 1, 2, 3-4, 5-8 and so on.
+	Branching []int
+
+	// DeadEnds counts the prefixes generation can reach but that have
+	// no suffixes, even after backing off, so that generation stops
+	// there. DeadEndTransitions counts the observations leading to them.
+	DeadEnds           int
+	DeadEndTransitions int
+}
+
+// known reports whether generation finds suffixes for p, backing off to
+// shorter prefixes in a backoff model.
+func (c *Chain) known(p Prefix) bool {
+	for k := len(p); k >= c.minOrder; k-- {
+		if _, ok := c.chain[p[len(p)-k:].String()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats computes the statistics of c.
+func (c *Chain) Stats() Stats {
+	st := Stats{Prefixes: len(c.chain), ByOrder: make(map[int]int)}
+	vocab := make(map[string]bool)
+	deadEnds := make(map[string]bool)
+	var full int
+	for key, tf := range c.chain {
+		p := splitKey(key)
+		st.ByOrder[len(p)]++
+		for word := range tf {
+			vocab[word] = true
+		}
+		if len(p) != c.prefixLen {
+			continue
+		}
+
+		full++
+		t := total(tf)
+		st.Pairs += len(tf)
+		st.Transitions += t
+		h := 0.0
+		for _, count := range tf {
+			pr := float64(count) / float64(t)
+			h -= pr * math.Log2(pr)
+		}
+		st.MeanEntropy += h
+		st.WeightedEntropy += h * float64(t)
+		i := bits.Len(uint(len(tf) - 1))
+		for len(st.Branching) <= i {
+			st.Branching = append(st.Branching, 0)
+		}
+		st.Branching[i]++
+
+		next := make(Prefix, len(p))
+		for word, count := range tf {
+			if word == sentenceEnd { // generation starts a new sentence
+				continue
+			}
+			copy(next, p[1:])
+			next[len(next)-1] = word
+			if !c.known(next) {
+				deadEnds[next.String()] = true
+				st.DeadEndTransitions += count
+			}
+		}
+	}
+	st.Vocabulary = len(vocab)
+	st.DeadEnds = len(deadEnds)
+	if full > 0 {
+		st.MeanEntropy /= float64(full)
+	}
+	if st.Transitions > 0 {
+		st.WeightedEntropy /= float64(st.Transitions)
+	}
+	return st
+}
+
+// percent returns n as a percentage of total.
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// runStats prints the statistics of a model: mark stats modelfile
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 1 {
+		return usageError("stats command should be: mark stats modelfile")
+	}
+	c, _, err := ReadChainFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	st := c.Stats()
+	fmt.Printf("prefix length:     %d", c.prefixLen)
+	if c.minOrder < c.prefixLen {
+		fmt.Printf(" (backoff down to %d)", c.minOrder)
+	}
+	fmt.Printf("\ntokenizer:         %s\n", c.tokenizer)
+	fmt.Printf("prefixes:          %d\n", st.Prefixes)
+	if c.minOrder < c.prefixLen {
+		for k := c.minOrder; k <= c.prefixLen; k++ {
+			fmt.Printf("  of %d word(s):    %d\n", k, st.ByOrder[k])
+		}
+	}
+	fmt.Printf("distinct suffixes: %d\n", st.Vocabulary)
+	fmt.Printf("distinct pairs:    %d\n", st.Pairs)
+	fmt.Printf("transitions:       %d\n", st.Transitions)
+	fmt.Printf("dead ends:         %d prefixes, reached by %.2f%% of transitions\n",
+		st.DeadEnds, percent(st.DeadEndTransitions, st.Transitions))
+	fmt.Printf("entropy:           %.3f bits per prefix, %.3f weighted by observations\n",
+		st.MeanEntropy, st.WeightedEntropy)
+	fmt.Println("branching factor:")
+	full := st.ByOrder[c.prefixLen]
+	for i, n := range st.Branching {
+		lo, hi := 1<<uint(i-1)+1, 1<<uint(i)
+		label := fmt.Sprintf("%d-%d", lo, hi)
+		switch {
+		case i == 0:
+			label = "1"
+		case lo == hi:
+			label = fmt.Sprint(hi)
+		}
+		fmt.Printf("  %-10s %10d %6.2f%%\n", label, n, percent(n, full))
+	}
+	return nil
+}
+
+// runQuery prints the suffixes of a prefix, most probable first:
+// mark query [-top n] modelfile "I am"
+func runQuery(args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	top := flags.Int("top", 0, "print only the n most probable suffixes (0: all)")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 2 {
+		return usageError("query command should be: mark query [-top n] modelfile prefix")
+	}
+	c, _, err := ReadChainFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Look the prefix up the way generation continues a --start phrase.
+	words := tokenize(c.tokenizer, args[1])
+	p := make(Prefix, c.prefixLen)
+	if len(words) > len(p) {
+		words = words[len(words)-len(p):]
+	}
+	copy(p[len(p)-len(words):], words)
+	var tf map[string]int
+	for k := len(p); k >= c.minOrder && tf == nil; k-- {
+		if tf = c.chain[p[len(p)-k:].String()]; tf != nil && k < len(p) {
+			fmt.Printf("prefix [%s] is unknown, backing off to [%s]\n",
+				p.display(), p[len(p)-k:].display())
+			p = p[len(p)-k:]
+		}
+	}
+	if tf == nil {
+		return fmt.Errorf("prefix [%s] is not in the model", p.display())
+	}
+
+	words = make([]string, 0, len(tf))
+	for word := range tf {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if tf[words[i]] != tf[words[j]] {
+			return tf[words[i]] > tf[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	t := total(tf)
+	fmt.Printf("prefix [%s]: %d observations, %d suffixes\n", p.display(), t, len(tf))
+	if *top > 0 && len(words) > *top {
+		words = words[:*top]
+	}
+	for _, word := range words {
+		fmt.Printf("%8.4f %8d  %s\n", float64(tf[word])/float64(t), tf[word],
+			Prefix{word}.display())
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// StreamOptions tell Stream where to start and when to stop. A zero value
+// disables the condition.
+type StreamOptions struct {
+	Start    Prefix   // prefix to continue from, padded like GenerateFrom's start
+	After    string   // word already written before the stream, for spacing
+	Sampling Sampling // how to draw every suffix
+
+	MaxWords   int            // stop after this many words
+	MaxBytes   int            // stop before writing more than this many bytes
+	Sentences  int            // stop after this many complete sentences
+	StopToken  string         // stop after writing this word
+	StopRegexp *regexp.Regexp // stop after writing a word that matches
+
+	// Restart continues from a random sentence start, drawn in
+	// proportion to how often it was seen, instead of stopping at a
+	// prefix without suffixes. It needs another stop condition.
+	Restart bool
+	// CycleWindow, if positive, makes a prefix seen in the last
+	// CycleWindow steps prefer suffixes it did not lead to then.
+	CycleWindow int
+}
+
+// sentenceStarts returns the prefixes of full length that start a sentence,
+// with their totals as frequencies: the empty prefix that every input
+// starts from, and the prefixes whose last word ends a sentence. It is
+// computed once and sorted, so that restarts depend only on the random
+// numbers drawn.
+func (c *ChainForGenerate) sentenceStarts() *suffixes {
+	c.startsOnce.Do(func() {
+		totals := make(map[string]int)
+		var keys []string
+		c.each(func(key string, t int) {
+			p := splitKey(key)
+			if len(p) == c.prefixLen && (isEmptyPrefix(p) || endsSentence(p[len(p)-1])) {
+				keys = append(keys, key)
+				totals[key] = t
+			}
+		})
+		sort.Strings(keys)
+		c.starts = new(suffixes)
+		for _, key := range keys {
+			c.starts.add(key, totals[key])
+		}
+	})
+	return c.starts
+}
+
+// endsSentence reports whether word ends with ".", "!" or "?", possibly
+// followed by closing quotes or brackets.
+func endsSentence(word string) bool {
+	word = strings.TrimRight(word, "\"'”’)]}")
+	return word != "" && strings.ContainsAny(word[len(word)-1:], ".!?")
+}
+
+// Stream writes words generated from the chain to w as they are drawn from
+// rng, spaced the way the model's tokenizer split them, until a stop
+// condition of opts holds, the current prefix has no suffixes (unless
+// opts.Restart is set) or ctx is done. It returns the number of words written and the error of ctx or w,
+// if any.
+func (c *ChainForGenerate) Stream(ctx context.Context, w io.Writer, rng *rand.Rand, opts StreamOptions) (int, error) {
+	tok := tokenizers[c.tokenizer]
+	g := c.newGenerator(rng, opts.Start)
+	g.sampling = opts.Sampling
+	g.restart, g.window = opts.Restart, opts.CycleWindow
+	prev := opts.After
+	words, size := 0, 0
+	for opts.MaxWords <= 0 || words < opts.MaxWords {
+		if opts.Sentences > 0 && g.sentences >= opts.Sentences {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return words, err
+		}
+		next, ok := g.next()
+		if !ok {
+			break
+		}
+		if next == sentenceStart || next == sentenceEnd {
+			continue
+		}
+
+		out := next
+		if prev != "" {
+			out = tok.Separator(prev, next) + next
+		}
+		if opts.MaxBytes > 0 && size+len(out) > opts.MaxBytes {
+			break
+		}
+		if _, err := io.WriteString(w, out); err != nil {
+			return words, err
+		}
+		size += len(out)
+		words++
+		prev = next
+
+		if next == opts.StopToken || (opts.StopRegexp != nil && opts.StopRegexp.MatchString(next)) {
+			break
+		}
+	}
+	return words, nil
+}
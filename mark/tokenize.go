@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Tokenizer splits text into the tokens a Chain counts, and tells how to
+// space generated tokens to make text again.
+type Tokenizer interface {
+	// Tokenize calls emit for every token read from r, in order.
+	Tokenize(r io.Reader, emit func(token string)) error
+	// Separator returns what to write between the tokens prev and next.
+	Separator(prev, next string) string
+}
+
+// joinTokens returns the text made of tokens, separated the way tok says.
+func joinTokens(tok Tokenizer, tokens []string) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 {
+			b.WriteString(tok.Separator(tokens[i-1], t))
+		}
+		b.WriteString(t)
+	}
+	return b.String()
+}
+
+// Markers the sentence tokenizer puts around every sentence. A Chain
+// starts again from the empty prefix at every sentenceStart, and generation
+// counts a complete sentence at every sentenceEnd.
+const (
+	sentenceStart = "<s>"
+	sentenceEnd   = "</s>"
+)
+
+// tokenizers maps the names accepted by --tokenizer, and stored in model
+// headers, to Tokenizers.
+var tokenizers = map[string]Tokenizer{
+	"whitespace": whitespaceTokenizer{},
+	"punct":      punctTokenizer{},
+	"sentence":   sentenceTokenizer{},
+	"char":       charTokenizer{},
+}
+
+// defaultTokenizer is the tokenizer of models that do not name one.
+const defaultTokenizer = "whitespace"
+
+// whitespaceTokenizer splits text at white space, so punctuation stays
+// attached to its word: "man!" is a single token.
+type whitespaceTokenizer struct{}
+
+func (whitespaceTokenizer) Tokenize(r io.Reader, emit func(string)) error {
+	for {
+		var s string
+		if _, err := fmt.Fscan(r, &s); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		emit(s)
+	}
+}
+
+func (whitespaceTokenizer) Separator(prev, next string) string {
+	return " "
+}
+
+// punctTokenizer splits text at white space and then splits leading and
+// trailing punctuation off each word: "(man!)" becomes "(", "man", "!",
+// ")". A run of the same punctuation mark, such as "...", is one token.
+// Punctuation inside a word, as in "don't", is kept.
+type punctTokenizer struct{}
+
+func (punctTokenizer) Tokenize(r io.Reader, emit func(string)) error {
+	return whitespaceTokenizer{}.Tokenize(r, func(word string) {
+		splitPunct(word, emit)
+	})
+}
+
+// Separator attaches closing punctuation to the token before it and opening
+// brackets to the token after them.
+func (punctTokenizer) Separator(prev, next string) string {
+	if allIn(next, ".,!?;:)]}") || allIn(prev, "([{") {
+		return ""
+	}
+	return " "
+}
+
+// splitPunct emits the leading punctuation, the core and the trailing
+// punctuation of word as separate tokens.
+func splitPunct(word string, emit func(string)) {
+	start, end := 0, len(word)
+	for start < end {
+		r, _ := utf8.DecodeRuneInString(word[start:])
+		if !unicode.IsPunct(r) {
+			break
+		}
+		n := punctRun(word[start:end])
+		emit(word[start : start+n])
+		start += n
+	}
+	// Find where the trailing punctuation starts, then emit it in order.
+	tail := end
+	for tail > start {
+		r, size := utf8.DecodeLastRuneInString(word[start:tail])
+		if !unicode.IsPunct(r) {
+			break
+		}
+		tail -= size
+	}
+	if start < tail {
+		emit(word[start:tail])
+	}
+	for tail < end {
+		n := punctRun(word[tail:end])
+		emit(word[tail : tail+n])
+		tail += n
+	}
+}
+
+// punctRun returns the length in bytes of the run of identical runes that
+// s starts with.
+func punctRun(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+	n := size
+	for n < len(s) {
+		next, size := utf8.DecodeRuneInString(s[n:])
+		if next != r {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// allIn reports whether every rune of token is one of chars.
+func allIn(token, chars string) bool {
+	return token != "" && strings.Trim(token, chars) == ""
+}
+
+// sentenceTokenizer splits text like punctTokenizer and marks sentences:
+// it emits sentenceStart before the first token of every sentence and
+// sentenceEnd after the marks that end it (".", "!" or "?", followed by
+// any further such marks and closing quotes or brackets). The last
+// sentence of the input is ended even if it has no final mark.
+type sentenceTokenizer struct{}
+
+func (sentenceTokenizer) Tokenize(r io.Reader, emit func(string)) error {
+	inSentence, ending := false, false
+	err := punctTokenizer{}.Tokenize(r, func(t string) {
+		if ending {
+			if allIn(t, ".!?\"'”’)]}") {
+				emit(t)
+				return
+			}
+			emit(sentenceEnd)
+			inSentence, ending = false, false
+		}
+		if !inSentence {
+			emit(sentenceStart)
+			inSentence = true
+		}
+		emit(t)
+		ending = allIn(t, ".!?")
+	})
+	if inSentence {
+		emit(sentenceEnd)
+	}
+	return err
+}
+
+func (sentenceTokenizer) Separator(prev, next string) string {
+	return punctTokenizer{}.Separator(prev, next)
+}
+
+// charTokenizer makes every UTF-8 character, white space included, a token
+// of its own, for models of the spelling of words rather than of text.
+// Invalid UTF-8 is read as utf8.RuneError.
+type charTokenizer struct{}
+
+func (charTokenizer) Tokenize(r io.Reader, emit func(string)) error {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		emit(string(c))
+	}
+}
+
+func (charTokenizer) Separator(prev, next string) string {
+	return ""
+}
+
+// tokenize returns the tokens of text split by the named tokenizer, for use
+// as the start of generation. sentenceEnd markers are left out, so that
+// generation continues the last sentence of text instead of starting anew.
+func tokenize(tokenizer, text string) []string {
+	var tokens []string
+	tokenizers[tokenizer].Tokenize(strings.NewReader(text), func(t string) {
+		if t != sentenceEnd {
+			tokens = append(tokens, t)
+		}
+	})
+	return tokens
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Avalanche describes the topplings set off by one grain dropped on a
+// stable board.
+type Avalanche struct {
+	Drop     int // number of the drop, from 1
+	R, C     int // cell the grain fell on
+	Size     int // topplings, counting a cell once per toppling
+	Area     int // distinct cells that toppled
+	Duration int // waves of toppling, see avalancher.drop
+	Extent   int // longer side of the bounding box of the cells that toppled
+}
+
+// avalancher drops grains on a stable board and measures the avalanches
+// they set off.
+type avalancher struct {
+	b       *Board
+	toppled []bool // cells toppled by the current avalanche
+	cells   []int  // the indices set in toppled
+	queued  []int  // last wave a cell was queued for
+	wave    int    // waves so far, over all avalanches
+}
+
+func newAvalancher(b *Board) *avalancher {
+	return &avalancher{b: b, toppled: make([]bool, len(b.cell)),
+		queued: make([]int, len(b.cell))}
+}
+
+// drop adds a grain to ( r, c) and stabilizes the board again. Toppling
+// goes in waves, as in the synchronous update of the Bak-Tang-Wiesenfeld
+// model: every cell unstable at the start of a wave topples once, and the
+// cells left unstable make up the next wave. The duration of the avalanche
+// is its number of waves.
+func (a *avalancher) drop(r, c int) Avalanche {
+	b := a.b
+	av := Avalanche{R: r, C: c}
+	i := r*b.cols + c
+	b.cell[i]++
+	if b.cell[i] < 4 {
+		return av
+	}
+	minR, maxR, minC, maxC := r, r, c, c
+	wave, next := []int{i}, []int(nil)
+	a.queued[i] = a.wave + 1
+	queue := func(j int) {
+		if b.cell[j] >= 4 && a.queued[j] != a.wave+1 {
+			a.queued[j] = a.wave + 1
+			next = append(next, j)
+		}
+	}
+	for len(wave) > 0 {
+		a.wave++
+		av.Duration++
+		for _, i := range wave {
+			b.cell[i] -= 4
+			av.Size++
+			r, c := i/b.cols, i%b.cols
+			if !a.toppled[i] {
+				a.toppled[i] = true
+				a.cells = append(a.cells, i)
+				minR, maxR = min(minR, r), max(maxR, r)
+				minC, maxC = min(minC, c), max(maxC, c)
+			}
+			queue(i)
+			for _, n := range [4]Cell{{r - 1, c}, {r + 1, c}, {r, c - 1}, {r, c + 1}} {
+				if b.Contains(n.r, n.c) {
+					j := n.r*b.cols + n.c
+					b.cell[j]++
+					queue(j)
+				}
+			}
+		}
+		// A cell queued for the next wave may have toppled after it was
+		// queued, later in this one.
+		wave = wave[:0]
+		for _, j := range next {
+			if b.cell[j] >= 4 {
+				wave = append(wave, j)
+			}
+		}
+		next = next[:0]
+	}
+
+	av.Area = len(a.cells)
+	av.Extent = max(maxR-minR, maxC-minC) + 1
+	for _, j := range a.cells {
+		a.toppled[j] = false
+	}
+	a.cells = a.cells[:0]
+	return av
+}
+
+// writeAvalanches writes avs to the named file as CSV, one avalanche per
+// line.
+func writeAvalanches(name string, avs []Avalanche) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	fmt.Fprintln(bw, "drop,row,col,size,area,duration,extent")
+	for _, av := range avs {
+		fmt.Fprintf(bw, "%d,%d,%d,%d,%d,%d,%d\n", av.Drop, av.R, av.C,
+			av.Size, av.Area, av.Duration, av.Extent)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fitPowerLaw fits the discrete power law p(x) = x^-alpha / zeta(alpha,
+// xmin) to the values of xs that are at least xmin, by maximum likelihood
+// (Clauset, Shalizi and Newman 2009, section 3.1). It returns alpha, its
+// standard error and the number n of values fitted; alpha is NaN if n is
+// 0, and +Inf if every value fitted is xmin.
+func fitPowerLaw(xs []int, xmin int) (alpha, stderr float64, n int) {
+	sum := 0.0 // of ln x
+	for _, x := range xs {
+		if x >= xmin {
+			sum += math.Log(float64(x))
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN(), math.NaN(), 0
+	}
+	q := float64(xmin)
+	mean := sum / float64(n)
+	if mean <= math.Log(q) {
+		return math.Inf(1), math.NaN(), n
+	}
+	// The log-likelihood per value, -ln zeta(alpha, xmin) - alpha*mean,
+	// is concave in alpha; its maximum is found by golden section search.
+	ll := func(a float64) float64 { return -math.Log(hurwitzZeta(a, q)) - a*mean }
+	lo, hi := 1.0+1e-9, 2.0
+	for ll(hi) > ll(hi-1e-6) && hi < 1e3 { // the maximum lies below hi
+		lo, hi = hi-1, 2*hi
+	}
+	g := (math.Sqrt(5) - 1) / 2
+	a, b := hi-g*(hi-lo), lo+g*(hi-lo)
+	for hi-lo > 1e-10 {
+		if ll(a) > ll(b) {
+			hi, b = b, a
+			a = hi - g*(hi-lo)
+		} else {
+			lo, a = a, b
+			b = lo + g*(hi-lo)
+		}
+	}
+	alpha = (lo + hi) / 2
+
+	// The Fisher information per value is the second derivative of
+	// ln zeta(alpha, xmin).
+	const h = 1e-4
+	d2 := (math.Log(hurwitzZeta(alpha+h, q)) - 2*math.Log(hurwitzZeta(alpha, q)) +
+		math.Log(hurwitzZeta(alpha-h, q))) / (h * h)
+	return alpha, 1 / math.Sqrt(float64(n)*d2), n
+}
+
+// hurwitzZeta returns zeta(s, q), the sum of (q+k)^-s over k >= 0, for s >
+// 1 and q > 0, by the Euler-Maclaurin formula.
+func hurwitzZeta(s, q float64) float64 {
+	const terms = 10
+	sum := 0.0
+	for k := 0; k < terms; k++ {
+		sum += math.Pow(q+float64(k), -s)
+	}
+	a := q + terms
+	sum += math.Pow(a, 1-s)/(s-1) + math.Pow(a, -s)/2
+	// Bernoulli numbers B_2j / (2j)!, for j = 1 to 6.
+	coef := []float64{1.0 / 12, -1.0 / 720, 1.0 / 30240, -1.0 / 1209600,
+		1.0 / 47900160, -691.0 / 1307674368000}
+	fact := s // s (s+1) ... (s+2j-2)
+	pow := math.Pow(a, -s-1)
+	for j, c := range coef {
+		sum += c * fact * pow
+		fact *= (s + float64(2*j+1)) * (s + float64(2*j+2))
+		pow /= a * a
+	}
+	return sum
+}
+
+// logBins counts the positive values of xs in bins [2^k, 2^(k+1)) and
+// returns the density of every bin that is not empty: its share of xs per
+// unit of x, at the geometric middle of the bin.
+func logBins(xs []int) (mid, density []float64) {
+	var counts []int
+	for _, x := range xs {
+		if x < 1 {
+			continue
+		}
+		k := 0
+		for x >= 2<<uint(k) {
+			k++
+		}
+		for len(counts) <= k {
+			counts = append(counts, 0)
+		}
+		counts[k]++
+	}
+	for k, n := range counts {
+		if n == 0 {
+			continue
+		}
+		lo := math.Exp2(float64(k))
+		mid = append(mid, lo*math.Sqrt2)
+		density = append(density, float64(n)/lo/float64(len(xs)))
+	}
+	return mid, density
+}
+
+// DrawHistogram plots the distribution of the avalanche sizes xs on log-log
+// axes, from logBins, together with the power law x^-alpha fitted to the
+// sizes from xmin on, and saves it to the named PNG file. The axes have a
+// tick at every power of ten.
+func DrawHistogram(name string, xs []int, alpha float64, xmin int) {
+	const width, height, margin = 640, 480, 40
+	mid, density := logBins(xs)
+	pic := CreateNewCanvas(width, height)
+	if len(mid) == 0 {
+		pic.SaveToPNG(name)
+		return
+	}
+
+	// The axes span whole decades around the data.
+	x0, x1 := math.Floor(math.Log10(mid[0])), math.Ceil(math.Log10(mid[len(mid)-1]))
+	y0, y1 := math.Inf(1), math.Inf(-1)
+	for _, d := range density {
+		y0, y1 = math.Min(y0, math.Log10(d)), math.Max(y1, math.Log10(d))
+	}
+	y0, y1 = math.Floor(y0), math.Ceil(y1)
+	if x1 == x0 {
+		x1++
+	}
+	if y1 == y0 {
+		y1++
+	}
+	px := func(x float64) float64 {
+		return margin + (math.Log10(x)-x0)/(x1-x0)*(width-2*margin)
+	}
+	py := func(y float64) float64 {
+		return height - margin - (math.Log10(y)-y0)/(y1-y0)*(height-2*margin)
+	}
+
+	pic.SetLineWidth(1)
+	pic.SetStrokeColor(MakeColor(0, 0, 0))
+	pic.MoveTo(margin, margin)
+	pic.LineTo(margin, height-margin)
+	pic.LineTo(width-margin, height-margin)
+	pic.Stroke()
+	for e := x0; e <= x1; e++ {
+		x := px(math.Pow(10, e))
+		pic.MoveTo(x, height-margin)
+		pic.LineTo(x, height-margin+6)
+		pic.Stroke()
+	}
+	for e := y0; e <= y1; e++ {
+		y := py(math.Pow(10, e))
+		pic.MoveTo(margin-6, y)
+		pic.LineTo(margin, y)
+		pic.Stroke()
+	}
+
+	if !math.IsNaN(alpha) && !math.IsInf(alpha, 0) {
+		// The fitted density, scaled to the share of xs it was fitted to.
+		_, _, n := fitPowerLaw(xs, xmin)
+		scale := float64(n) / float64(len(xs)) / hurwitzZeta(alpha, float64(xmin))
+		lo := math.Max(float64(xmin), math.Pow(10, x0))
+		hi := math.Pow(10, x1)
+		pic.SetStrokeColor(MakeColor(200, 0, 0))
+		pic.SetLineWidth(2)
+		pic.MoveTo(px(lo), py(scale*math.Pow(lo, -alpha)))
+		pic.LineTo(px(hi), py(scale*math.Pow(hi, -alpha)))
+		pic.Stroke()
+	}
+
+	pic.SetFillColor(MakeColor(0, 0, 200))
+	for i := range mid {
+		x, y := px(mid[i]), py(density[i])
+		pic.MoveTo(x-3, y-3)
+		pic.LineTo(x+3, y-3)
+		pic.LineTo(x+3, y+3)
+		pic.LineTo(x-3, y+3)
+		pic.LineTo(x-3, y-3)
+		pic.Fill()
+	}
+	pic.SaveToPNG(name)
+}
+
+// printFits prints the power law exponent of every distribution in avs.
+func printFits(avs []Avalanche, xmin int) {
+	toppled := 0
+	for _, av := range avs {
+		if av.Size > 0 {
+			toppled++
+		}
+	}
+	fmt.Printf("avalanches: %d drops, %d set off topplings\n", len(avs), toppled)
+	for _, m := range []struct {
+		name string
+		of   func(Avalanche) int
+	}{
+		{"size", func(av Avalanche) int { return av.Size }},
+		{"area", func(av Avalanche) int { return av.Area }},
+		{"duration", func(av Avalanche) int { return av.Duration }},
+		{"extent", func(av Avalanche) int { return av.Extent }},
+	} {
+		xs := make([]int, len(avs))
+		for i, av := range avs {
+			xs[i] = m.of(av)
+		}
+		alpha, stderr, n := fitPowerLaw(xs, xmin)
+		if n == 0 {
+			fmt.Printf("%-9s no avalanches of %d or more\n", m.name+":", xmin)
+			continue
+		}
+		if math.IsInf(alpha, 1) {
+			fmt.Printf("%-9s all %d avalanches of %d or more are of %d\n",
+				m.name+":", n, xmin, xmin)
+			continue
+		}
+		fmt.Printf("%-9s exponent %.3f ± %.3f (%d avalanches of %d or more)\n",
+			m.name+":", alpha, stderr, n, xmin)
+	}
+}
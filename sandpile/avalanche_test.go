@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestAvalancheDrop(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		rows, cols int
+		fill       int
+		r, c       int
+		want       Avalanche
+		cell       []int32 // the board afterwards
+	}{
+		// The center topples, then the four edges, then the center and
+		// the four corners together.
+		{"3x3 of 3s", 3, 3, 3, 1, 1, Avalanche{R: 1, C: 1, Size: 10, Area: 9,
+			Duration: 3, Extent: 3}, []int32{1, 3, 1, 3, 0, 3, 1, 3, 1}},
+		{"no toppling", 3, 3, 2, 0, 2, Avalanche{R: 0, C: 2},
+			[]int32{2, 2, 3, 2, 2, 2, 2, 2, 2}},
+		// Grains only leave a 1x1 board.
+		{"one cell", 1, 1, 3, 0, 0, Avalanche{Size: 1, Area: 1, Duration: 1, Extent: 1},
+			[]int32{0}},
+		// Each cell topples once, one wave after the other.
+		{"one row", 1, 4, 3, 0, 0, Avalanche{Size: 4, Area: 4, Duration: 4, Extent: 4},
+			[]int32{1, 1, 1, 0}},
+	} {
+		b := newBoard(tc.rows, tc.cols)
+		for i := range b.cell {
+			b.cell[i] = int32(tc.fill)
+		}
+		av := newAvalancher(b).drop(tc.r, tc.c)
+		if av != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, av, tc.want)
+		}
+		if !slices.Equal(b.cell, tc.cell) {
+			t.Errorf("%s: board afterwards %v, want %v", tc.name, b.cell, tc.cell)
+		}
+	}
+}
+
+// TestAvalancheBoard checks that drop leaves the board ComputeSteadyState
+// would, and that the measures of every avalanche fit together.
+func TestAvalancheBoard(t *testing.T) {
+	b := benchPile(31, 3000)
+	ComputeSteadyState(b)
+	want := newBoard(b.rows, b.cols)
+	copy(want.cell, b.cell)
+	a := newAvalancher(b)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		r, c := rng.Intn(b.rows), rng.Intn(b.cols)
+		av := a.drop(r, c)
+		want.AddGrains(r, c, 1)
+		ComputeSteadyState(want)
+		if !slices.Equal(b.cell, want.cell) {
+			t.Fatalf("drop %d on (%d, %d): board differs from ComputeSteadyState", i+1, r, c)
+		}
+		if av.Size < av.Area || av.Area < av.Extent || av.Size < av.Duration ||
+			(av.Size == 0) != (av.Duration == 0) {
+			t.Errorf("drop %d: inconsistent avalanche %+v", i+1, av)
+		}
+	}
+}
+
+// powerLawSample returns n integers drawn from the discrete power law
+// p(x) = x^-alpha / zeta(alpha, xmin) for x >= xmin: by inverting its
+// distribution function up to a cutoff, and beyond it, where the discrete
+// law is all but continuous, by rounding the continuous one.
+func powerLawSample(rng *rand.Rand, n int, alpha float64, xmin int) []int {
+	const cutoff = 100000
+	z := hurwitzZeta(alpha, float64(xmin))
+	cdf := make([]float64, cutoff-xmin)
+	sum := 0.0
+	for i := range cdf {
+		sum += math.Pow(float64(xmin+i), -alpha) / z
+		cdf[i] = sum
+	}
+	xs := make([]int, n)
+	for i := range xs {
+		u := rng.Float64()
+		if j := sort.SearchFloat64s(cdf, u); j < len(cdf) {
+			xs[i] = xmin + j
+			continue
+		}
+		x := (cutoff - 0.5) * math.Pow(1-rng.Float64(), -1/(alpha-1))
+		xs[i] = int(math.Round(x))
+	}
+	return xs
+}
+
+func TestFitPowerLaw(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, alpha := range []float64{1.5, 2, 2.5, 3} {
+		for _, xmin := range []int{1, 2, 6, 20} {
+			xs := powerLawSample(rng, 50000, alpha, xmin)
+			// Values below xmin must be left out of the fit.
+			xs = append(xs, 0, 0, xmin-1)
+			got, stderr, n := fitPowerLaw(xs, xmin)
+			if n != 50000 {
+				t.Errorf("alpha %g, xmin %d: fitted %d values, want 50000", alpha, xmin, n)
+			}
+			// The standard error is about (alpha-1)/sqrt(n) for a large
+			// xmin, and larger for a small one.
+			if se := (alpha - 1) / math.Sqrt(50000); stderr < 0.95*se || stderr > 1.5*se {
+				t.Errorf("alpha %g, xmin %d: standard error %g", alpha, xmin, stderr)
+			}
+			if math.Abs(got-alpha) > 4*stderr {
+				t.Errorf("alpha %g, xmin %d: fitted %.4f ± %.4f", alpha, xmin, got, stderr)
+			}
+		}
+	}
+	if alpha, _, n := fitPowerLaw([]int{1, 2, 3}, 4); n != 0 || !math.IsNaN(alpha) {
+		t.Errorf("fit of no values: alpha %g from %d values, want NaN from 0", alpha, n)
+	}
+	if alpha, _, n := fitPowerLaw([]int{1, 3, 3, 3}, 3); n != 3 || !math.IsInf(alpha, 1) {
+		t.Errorf("fit of xmin only: alpha %g from %d values, want +Inf from 3", alpha, n)
+	}
+}
+
+func TestHurwitzZeta(t *testing.T) {
+	for _, tc := range []struct{ s, q, want float64 }{
+		{2, 1, math.Pi * math.Pi / 6},
+		{1.5, 1, 2.612375348685488},
+		{3, 1, 1.2020569031595942},
+		{2, 6, math.Pi*math.Pi/6 - 1 - 1.0/4 - 1.0/9 - 1.0/16 - 1.0/25},
+		{4, 0.5, math.Pow(math.Pi, 4) / 6}, // (2^4 - 1) zeta(4)
+	} {
+		if got := hurwitzZeta(tc.s, tc.q); math.Abs(got-tc.want) > 1e-12*tc.want {
+			t.Errorf("hurwitzZeta(%g, %g) = %.16g, want %.16g", tc.s, tc.q, got, tc.want)
+		}
+	}
+}
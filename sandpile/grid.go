@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Grid files hold a number of grains per cell, row after row. The format is
+// told by the file name: ".pgm" for a plain (P2) or raw (P5) PGM image
+// whose gray levels are the grain counts, ".csv" for comma-separated
+// values, and anything else for rows of integers separated by white space.
+// In CSV and text grids, blank lines and lines starting with # are skipped.
+
+// readGrid reads the grid in the named file. All rows have the same length.
+func readGrid(name string) ([][]int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var grid [][]int
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pgm":
+		grid, err = readPGM(bufio.NewReader(f))
+	case ".csv":
+		grid, err = readRows(f, func(line string) []string { return strings.Split(line, ",") })
+	default:
+		grid, err = readRows(f, strings.Fields)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(grid) == 0 {
+		return nil, fmt.Errorf("%s: empty grid", name)
+	}
+	return grid, nil
+}
+
+// readRows reads a text grid whose lines are split into cells by split.
+func readRows(r io.Reader, split func(string) []string) ([][]int, error) {
+	var grid [][]int
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<30)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var row []int
+		for _, field := range split(line) {
+			n, err := parseGrains(strings.TrimSpace(field))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			row = append(row, n)
+		}
+		if len(grid) > 0 && len(row) != len(grid[0]) {
+			return nil, fmt.Errorf("line %d: %d cells, want %d like the first row",
+				lineno, len(row), len(grid[0]))
+		}
+		grid = append(grid, row)
+	}
+	return grid, sc.Err()
+}
+
+// parseGrains parses the grain count of a cell.
+func parseGrains(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("bad grain count %q", s)
+	}
+	return n, nil
+}
+
+// readPGM reads a PGM image, taking every gray level as a grain count.
+func readPGM(br *bufio.Reader) ([][]int, error) {
+	var header [4]string
+	for i := range header {
+		tok, err := pgmToken(br)
+		if err != nil {
+			return nil, fmt.Errorf("bad PGM header: %v", err)
+		}
+		header[i] = tok
+	}
+	if header[0] != "P2" && header[0] != "P5" {
+		return nil, fmt.Errorf("not a PGM image")
+	}
+	var dims [3]int
+	for i := range dims {
+		n, err := strconv.Atoi(header[i+1])
+		if err != nil || n < 1 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("bad PGM header field %q", header[i+1])
+		}
+		dims[i] = n
+	}
+	width, height, maxval := dims[0], dims[1], dims[2]
+	if maxval > 65535 {
+		return nil, fmt.Errorf("PGM maximum gray level %d is above 65535", maxval)
+	}
+
+	grid := make([][]int, height)
+	for r := range grid {
+		grid[r] = make([]int, width)
+		for c := range grid[r] {
+			var n int
+			if header[0] == "P2" {
+				tok, err := pgmToken(br)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: %v", r+1, err)
+				}
+				if n, err = parseGrains(tok); err != nil {
+					return nil, fmt.Errorf("row %d: %v", r+1, err)
+				}
+			} else {
+				// One white space character ends the header of a raw
+				// image; pgmToken left it unread.
+				if r == 0 && c == 0 {
+					br.ReadByte()
+				}
+				b, err := br.ReadByte()
+				if err == nil && maxval > 255 {
+					var lo byte
+					lo, err = br.ReadByte()
+					n = int(b)<<8 | int(lo)
+				} else {
+					n = int(b)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("row %d: image is truncated", r+1)
+				}
+			}
+			if n > maxval {
+				return nil, fmt.Errorf("row %d: gray level %d is above the maximum %d",
+					r+1, n, maxval)
+			}
+			grid[r][c] = n
+		}
+	}
+	return grid, nil
+}
+
+// pgmToken returns the next white-space separated token of a PGM header or
+// plain image, skipping # comments, and leaves the character after it
+// unread.
+func pgmToken(br *bufio.Reader) (string, error) {
+	var tok []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(tok) > 0 {
+				return string(tok), nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		switch {
+		case b == '#' && len(tok) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", io.ErrUnexpectedEOF
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(tok) > 0 {
+				br.UnreadByte()
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, b)
+		}
+	}
+}
+
+// writeGrid writes the cells of b to the named file, in the format its
+// name tells; a PGM grid is written as a plain image.
+func writeGrid(name string, b *Board) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	sep := " "
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pgm":
+		maxval := 1
+		for _, n := range b.cell {
+			if int(n) > maxval {
+				maxval = int(n)
+			}
+		}
+		if maxval > 65535 {
+			f.Close()
+			return fmt.Errorf("%s: a cell holds %d grains, more than PGM allows", name, maxval)
+		}
+		fmt.Fprintf(bw, "P2\n%d %d\n%d\n", b.cols, b.rows, maxval)
+	case ".csv":
+		sep = ","
+	}
+	for r := 0; r < b.rows; r++ {
+		for c := 0; c < b.cols; c++ {
+			if c > 0 {
+				bw.WriteString(sep)
+			}
+			bw.WriteString(strconv.Itoa(b.Cell(r, c)))
+		}
+		bw.WriteString("\n")
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testGrid returns a board of rows by cols cells whose grain counts go up
+// to most.
+func testGrid(rows, cols, most int) *Board {
+	b := newBoard(rows, cols)
+	for i := range b.cell {
+		b.cell[i] = int32(i * 7919 % (most + 1))
+	}
+	b.cell[0] = int32(most)
+	return b
+}
+
+func gridCells(grid [][]int) []int32 {
+	var cells []int32
+	for _, row := range grid {
+		for _, n := range row {
+			cells = append(cells, int32(n))
+		}
+	}
+	return cells
+}
+
+func TestGridRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"grid.csv", "grid.txt", "grid.pgm", "GRID.PGM"} {
+		for _, most := range []int{3, 255, 65535} {
+			b := testGrid(5, 8, most)
+			path := filepath.Join(dir, name)
+			if err := writeGrid(path, b); err != nil {
+				t.Fatalf("%s, up to %d: %v", name, most, err)
+			}
+			grid, err := readGrid(path)
+			if err != nil {
+				t.Fatalf("%s, up to %d: %v", name, most, err)
+			}
+			if len(grid) != b.rows || len(grid[0]) != b.cols ||
+				!slices.Equal(gridCells(grid), b.cell) {
+				t.Errorf("%s, up to %d: read back\n%v\nwant\n%v", name, most, grid, b.cell)
+			}
+		}
+	}
+}
+
+// rawPGM returns a raw (P5) PGM image of the cells of b, with two bytes to
+// a gray level if maxval is above 255.
+func rawPGM(b *Board, maxval int) []byte {
+	data := []byte(fmt.Sprintf("P5\n# grains\n%d %d\n%d\n", b.cols, b.rows, maxval))
+	for _, n := range b.cell {
+		if maxval > 255 {
+			data = append(data, byte(n>>8))
+		}
+		data = append(data, byte(n))
+	}
+	return data
+}
+
+func TestReadRawPGM(t *testing.T) {
+	dir := t.TempDir()
+	for _, maxval := range []int{3, 255, 256, 65535} {
+		b := testGrid(4, 9, maxval)
+		path := filepath.Join(dir, fmt.Sprintf("raw%d.pgm", maxval))
+		if err := os.WriteFile(path, rawPGM(b, maxval), 0644); err != nil {
+			t.Fatal(err)
+		}
+		grid, err := readGrid(path)
+		if err != nil {
+			t.Fatalf("maxval %d: %v", maxval, err)
+		}
+		if len(grid) != b.rows || len(grid[0]) != b.cols ||
+			!slices.Equal(gridCells(grid), b.cell) {
+			t.Errorf("maxval %d: read\n%v\nwant\n%v", maxval, grid, b.cell)
+		}
+	}
+}
+
+func TestReadBadGrid(t *testing.T) {
+	dir := t.TempDir()
+	raw := rawPGM(testGrid(4, 9, 65535), 65535)
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string // part of the error message
+	}{
+		{"empty.csv", "# nothing\n", "empty grid"},
+		{"ragged.csv", "1,2,3\n4,5\n", "line 2: 2 cells, want 3"},
+		{"negative.txt", "1 2\n3 -4\n", `line 2: bad grain count "-4"`},
+		{"word.txt", "1 two\n", `bad grain count "two"`},
+		{"magic.pgm", "P6\n2 2\n255\n", "not a PGM image"},
+		{"header.pgm", "P2\n2 x\n3\n", `bad PGM header field "x"`},
+		{"maxval.pgm", "P2\n1 1\n70000\n1\n", "above 65535"},
+		{"level.pgm", "P2\n2 1\n3\n1 4\n", "gray level 4 is above the maximum 3"},
+		{"short.pgm", "P2\n2 2\n3\n1 2 3\n", "row 2"},
+		{"truncated.pgm", string(raw[:len(raw)-1]), "row 4: image is truncated"},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(path, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := readGrid(path)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tc.name, err, tc.err)
+		}
+	}
+}
@@ -1,18 +1,23 @@
 package main 
 
 import (
+	"flag"
 	"fmt"
-	"os"
+	"math"
+	"math/rand"
 	"strconv"
+	"strings"
+	"time"
 )
 
 
 
 //Board
 type Board struct {
-	size int  // number of rows and cols in the board
-	cell [][]int // 
-	st stack // 
+	rows, cols int // size of the board
+	cell []int32 // row after row, cell ( r, c) at r*cols+c
+	st stack // unstable cells
+	single bool // topple 4 grains at a time instead of all at once
 }
 
 //
@@ -34,41 +39,29 @@ func (s *stack) Pop() Cell {
 }
 
 
-//Create a new Board, initilize it with efualt configuration
-func createBoard(size, numOfSandpiles int) *Board {
-	cell := make([][]int, size, size);
-	for i := 0; i < size; i++ {
-		cell[i] = make([]int, size)
-		for j := 0; j < size; j++ {
-			cell[i][j] = 0
-		}
-	}
-	cell[size/2][size/2] = numOfSandpiles
-	st := make(stack, 0)
-	if numOfSandpiles >= 4 {
-		st.Push(Cell{size/2, size/2})
-	}
-	return &Board{size, cell, st}
+// newBoard returns an empty Board of rows by cols cells.
+func newBoard(rows, cols int) *Board {
+	return &Board{rows, cols, make([]int32, rows*cols), make(stack, 0), false}
 }
 
 // returns true if ( r, c) is within the field.
 // otherwise return false
 func (b *Board) Contains(r, c int) bool {
-	if r >= 0 && c >= 0 && r < b.size && c < b.size { return true }
+	if r >= 0 && c >= 0 && r < b.rows && c < b.cols { return true }
 	return false
 }
 
 // sets the value of cell ( r, c)
 func (b *Board) Set(r, c, value int) {
 	if b.Contains(r, c) {
-		b.cell[r][c] = value
+		b.cell[r*b.cols+c] = int32(value)
 	}
 }
 
 // returns the value of the cell ( r, c).
 func (b *Board) Cell(r, c int) int {
 	if b.Contains(r, c) {
-		return b.cell[r][c]
+		return int(b.cell[r*b.cols+c])
 	}
 	return -1;
 }
@@ -81,13 +74,16 @@ func (b *Board) isConverged() bool {
 }
 
 func (b *Board) NumRows() int {
-	return b.size
+	return b.rows
 }
 
 func (b *Board) NumCols() int {
-	return b.size
+	return b.cols
 }
 
+// Topple moves 4 grains from ( r, c) to its four neighbours, once; grains
+// that fall off the board are lost. Cells it makes unstable are pushed on
+// the board's stack rather than toppled here, so toppling never recurses.
 func (b *Board) Topple(r, c int) {
 	value := b.Cell(r, c)
 	b.Set(r, c, value - 4)
@@ -100,38 +96,77 @@ func (b *Board) Topple(r, c int) {
 	b.UpdateCell(r, c+1)
 }
 
+// ToppleAll topples ( r, c) as many times as it can in one step: of its v
+// grains, v/4 go to each neighbour and v%4 stay. This is what v/4 calls of
+// Topple would do, without pushing the cell back on the stack in between.
+func (b *Board) ToppleAll(r, c int) {
+	value := b.Cell(r, c)
+	n := value / 4
+	b.Set(r, c, value % 4)
+	b.AddGrains(r-1, c, n)
+	b.AddGrains(r+1, c, n)
+	b.AddGrains(r, c-1, n)
+	b.AddGrains(r, c+1, n)
+}
+
+// UpdateCell adds a grain to ( r, c), see AddGrains.
 func (b *Board) UpdateCell(r, c int) {
+	b.AddGrains(r, c, 1)
+}
+
+// AddGrains adds n grains to ( r, c) and pushes the cell on the stack when
+// it becomes unstable. A cell is pushed only as it reaches 4 grains, so it
+// is on the stack at most once.
+func (b *Board) AddGrains(r, c, n int) {
 	if b.Contains(r, c) {
-		b.Set(r, c, b.Cell(r, c) + 1)
-		if b.Cell(r, c) >= 4 {
-			b.Topple(r, c)
+		value := b.Cell(r, c)
+		b.Set(r, c, value + n)
+		if value < 4 && value + n >= 4 {
+			b.st.Push(Cell{r, c})
 		}
 	}
 }
 
+// ComputeSteadyState topples unstable cells until every cell holds fewer
+// than 4 grains. The order of topplings does not change the result (the
+// sandpile is abelian), so the cells are taken from the stack in any order.
+// Every cell is toppled with ToppleAll, or with Topple if b.single is set.
+// A board with more grains to shed than it has rows is swept instead, see
+// tile.sweep.
 func ComputeSteadyState(b *Board) {
+	if !b.single && shedding(b, b.st) >= b.rows {
+		t := &tile{r0: 0, r1: b.rows, st: b.st}
+		t.sweep(b)
+		b.st = t.st
+		return
+	}
 	for !b.st.Empty() {
-		//fmt.Println(len(b.st))
 		cell := b.st.Pop()
-		b.Topple(cell.r, cell.c)
+		switch {
+		case b.Cell(cell.r, cell.c) < 4:
+		case b.single:
+			b.Topple(cell.r, cell.c)
+		default:
+			b.ToppleAll(cell.r, cell.c)
+		}
 	}
 }
 
 func DrawBoard(b *Board) {
-	pic := CreateNewCanvas(b.size, b.size)
+	pic := CreateNewCanvas(b.cols, b.rows)
 	pic.SetLineWidth(1)
-	for i := 0; i < b.size; i++ {
-		for j := 0; j < b.size; j++ {
-			if b.cell[i][j] == 0 {
+	for i := 0; i < b.rows; i++ {
+		for j := 0; j < b.cols; j++ {
+			if b.Cell(i, j) == 0 {
 				// if the cell is 0, draw black sqaure
 				drawSquare(pic, i, j, "balck") 
-			} else if b.cell[i][j] == 1 {
+			} else if b.Cell(i, j) == 1 {
 				// if the cell if 1, draw dark gray sqaure
 				drawSquare(pic, i, j, "darkGray") 
-			} else if b.cell[i][j] == 2 {
+			} else if b.Cell(i, j) == 2 {
 				// if the cell if 1, draw dark gray sqaure
 				drawSquare(pic, i, j, "lightGray") 
-			} else if b.cell[i][j] == 3 {
+			} else if b.Cell(i, j) == 3 {
 				// if the cell if 1, draw dark gray sqaure
 				drawSquare(pic, i, j, "white") 
 			}
@@ -175,24 +210,209 @@ func drawSquare(pic Canvas, r, c int, color string) {
 	pic.Fill()
 }
 
+// pile is a -pile argument: n grains dropped on ( r, c).
+type pile struct {
+	r, c, n int
+}
+
+// pileList collects the values of a repeated -pile flag.
+type pileList []pile
+
+func (l *pileList) String() string { return fmt.Sprint(*l) }
+
+func (l *pileList) Set(s string) error {
+	f := strings.Split(s, ",")
+	if len(f) != 3 {
+		return fmt.Errorf("pile should be r,c,n")
+	}
+	var v [3]int
+	for i := range v {
+		n, err := strconv.Atoi(strings.TrimSpace(f[i]))
+		if err != nil || n < 0 {
+			return fmt.Errorf("pile should be r,c,n with non-negative integers")
+		}
+		v[i] = n
+	}
+	*l = append(*l, pile{v[0], v[1], v[2]})
+	return nil
+}
+
+// fileList collects the values of a repeated -grid flag.
+type fileList []string
+
+func (l *fileList) String() string { return strings.Join(*l, ",") }
+
+func (l *fileList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseSize parses a board size, SIZE for a square board or ROWSxCOLS.
+func parseSize(s string) (rows, cols int, ok bool) {
+	r, c := s, s
+	if i := strings.IndexAny(s, "xX"); i >= 0 {
+		r, c = s[:i], s[i+1:]
+	}
+	rows, err1 := strconv.Atoi(r)
+	cols, err2 := strconv.Atoi(c)
+	return rows, cols, err1 == nil && err2 == nil && rows >= 1 && cols >= 1
+}
+
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Error: command should be: sandpile SIZE PILE")
+	var grids fileList
+	var piles pileList
+	workers := flag.Int("workers", 1,
+		"number of goroutines toppling tiles of the board concurrently;"+
+			" tiles do about twice the work in all, so this pays only with cores to spare")
+	single := flag.Bool("single", false,
+		"topple 4 grains at a time instead of all the grains a cell can shed")
+	flag.Var(&grids, "grid",
+		"start from the grid in `file` (.csv, .pgm or text); grids given more than once are added")
+	flag.Var(&piles, "pile", "drop n grains on row r, column c (`r,c,n`); can be repeated")
+	drops := flag.Int("drop", 0,
+		"after stabilizing, add n grains one at a time at random cells, stabilizing after each")
+	seed := flag.Int64("seed", 0, "random seed for -drop (default: the current time)")
+	save := flag.String("save", "", "write the final grid to `file` (.csv, .pgm or text)")
+	avalanches := flag.String("avalanches", "",
+		"record the avalanche every -drop grain sets off to `file` as CSV,"+
+			" and fit power laws to their distributions")
+	hist := flag.String("hist", "avalanches.png",
+		"with -avalanches, plot the distribution of avalanche sizes to `file`")
+	fitMin := flag.Int("fit-min", 6, "with -avalanches, fit power laws to values of at least `n`;"+
+		" the smallest avalanches stray from the power law")
+	flag.Parse()
+	usage := "Error: command should be: sandpile [-workers n] [-single] [-grid file]..." +
+		" [-pile r,c,n]... [-drop n [-seed s] [-avalanches file.csv [-hist file.png]" +
+		" [-fit-min n]]] [-save file] [SIZE|ROWSxCOLS [PILE]]"
+	if flag.NArg() > 2 || (flag.NArg() == 0) == (len(grids) == 0) {
+		fmt.Println(usage)
+		fmt.Println("Give either a board size or a -grid file")
+		return
+	}
+	if *drops < 0 {
+		fmt.Println("Error: Number of drops should be an integer >= 0")
 		return
 	}
-	size, err := strconv.Atoi(os.Args[1]) // get board size
-	if err != nil {
-		fmt.Println("Error: Board size should be an integer")
+	if *avalanches != "" && *drops == 0 {
+		fmt.Println("Error: -avalanches records the avalanches of -drop grains; give -drop n")
 		return
 	}
+	if *fitMin < 1 {
+		fmt.Println("Error: -fit-min should be an integer >= 1")
+		return
+	}
+
+	var b *Board
+	var total int64 // grains put on the board, which must fit a cell
+	for i, name := range grids {
+		grid, err := readGrid(name)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		if i == 0 {
+			b = newBoard(len(grid), len(grid[0]))
+		} else if len(grid) != b.rows || len(grid[0]) != b.cols {
+			fmt.Printf("Error: %s is %dx%d, but %s is %dx%d\n", name, len(grid),
+				len(grid[0]), grids[0], b.rows, b.cols)
+			return
+		}
+		for r, row := range grid {
+			for c, n := range row {
+				if total += int64(n); total > math.MaxInt32 {
+					fmt.Println("Error: more than", math.MaxInt32, "grains in all")
+					return
+				}
+				b.AddGrains(r, c, n)
+			}
+		}
+	}
 
-	numOfSandpiles, err := strconv.Atoi(os.Args[2]) // get board size
-	if err != nil {
-		fmt.Println("Error: Number of sandpiles should be an integer")
+	numOfSandpiles := 0
+	if flag.NArg() > 0 {
+		rows, cols, ok := parseSize(flag.Arg(0))
+		if !ok {
+			fmt.Println("Error: Board size should be SIZE or ROWSxCOLS, integers >= 1")
+			return
+		}
+		if rows > math.MaxInt32/cols {
+			fmt.Println("Error: Board is too large")
+			return
+		}
+		b = newBoard(rows, cols)
+	}
+	if flag.NArg() > 1 {
+		var err error
+		numOfSandpiles, err = strconv.Atoi(flag.Arg(1)) // get board size
+		if err != nil || numOfSandpiles < 0 || numOfSandpiles > math.MaxInt32 {
+			fmt.Println("Error: Number of sandpiles should be an integer between 0 and",
+				math.MaxInt32)
+			return
+		}
+	}
+	total += int64(numOfSandpiles) + int64(*drops)
+	for _, p := range piles {
+		if !b.Contains(p.r, p.c) {
+			fmt.Printf("Error: pile %d,%d is off the %dx%d board\n", p.r, p.c, b.rows, b.cols)
+			return
+		}
+		total += int64(p.n)
+	}
+	if total > math.MaxInt32 {
+		fmt.Println("Error: more than", math.MaxInt32, "grains in all")
 		return
 	}
 
-	b := createBoard(size, numOfSandpiles)
-	ComputeSteadyState(b)
+	b.single = *single
+	b.AddGrains(b.rows/2, b.cols/2, numOfSandpiles)
+	for _, p := range piles {
+		b.AddGrains(p.r, p.c, p.n)
+	}
+	ComputeSteadyStateParallel(b, *workers)
+
+	if *drops > 0 {
+		seeded := false
+		flag.Visit(func(f *flag.Flag) { seeded = seeded || f.Name == "seed" })
+		if !seeded {
+			*seed = time.Now().UnixNano()
+		}
+		rng := rand.New(rand.NewSource(*seed))
+		var a *avalancher
+		var avs []Avalanche
+		if *avalanches != "" {
+			a = newAvalancher(b)
+			avs = make([]Avalanche, 0, *drops)
+		}
+		for i := 0; i < *drops; i++ {
+			r, c := rng.Intn(b.rows), rng.Intn(b.cols)
+			if a == nil {
+				b.AddGrains(r, c, 1)
+				ComputeSteadyState(b)
+				continue
+			}
+			av := a.drop(r, c)
+			av.Drop = i + 1
+			avs = append(avs, av)
+		}
+		if a != nil {
+			if err := writeAvalanches(*avalanches, avs); err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			printFits(avs, *fitMin)
+			sizes := make([]int, len(avs))
+			for i, av := range avs {
+				sizes[i] = av.Size
+			}
+			alpha, _, _ := fitPowerLaw(sizes, *fitMin)
+			DrawHistogram(*hist, sizes, alpha, *fitMin)
+		}
+	}
+
 	DrawBoard(b)
-}
\ No newline at end of file
+	if *save != "" {
+		if err := writeGrid(*save, b); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+}
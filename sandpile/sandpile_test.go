@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// stabilizeSync is the reference the stabilizers are checked against: in
+// every sweep of the grid, each cell holding 4 or more grains at the start
+// of the sweep topples once, all at the same time.
+func stabilizeSync(rows, cols int, cell []int32) []int32 {
+	cur := slices.Clone(cell)
+	for {
+		next := slices.Clone(cur)
+		moved := false
+		for r := 0; r < rows; r++ {
+			for c := 0; c < cols; c++ {
+				if cur[r*cols+c] < 4 {
+					continue
+				}
+				moved = true
+				next[r*cols+c] -= 4
+				for _, n := range [4]Cell{{r - 1, c}, {r + 1, c}, {r, c - 1}, {r, c + 1}} {
+					if n.r >= 0 && n.r < rows && n.c >= 0 && n.c < cols {
+						next[n.r*cols+n.c]++
+					}
+				}
+			}
+		}
+		if !moved {
+			return cur
+		}
+		cur = next
+	}
+}
+
+// stabilizeRecursive is the stabilizer the sandpile started with, kept
+// as a reference: Topple adds a grain to each neighbour with UpdateCell,
+// which topples the neighbour at once, recursively, if it reaches 4 grains.
+// The recursion goes as deep as the avalanche, so it is only fit for small
+// boards.
+//
+// The original popped every cell off the stack and toppled it, though the
+// recursion may have toppled it below 4 grains since it was pushed; that
+// drove cells negative on most boards. Here, as in ComputeSteadyState, such
+// a cell is skipped.
+func stabilizeRecursive(rows, cols int, cell []int32) []int32 {
+	cur := slices.Clone(cell)
+	var st stack
+	var topple, updateCell func(r, c int)
+	topple = func(r, c int) {
+		value := cur[r*cols+c]
+		cur[r*cols+c] = value - 4
+		if value-4 >= 4 {
+			st.Push(Cell{r, c})
+		}
+		updateCell(r-1, c)
+		updateCell(r+1, c)
+		updateCell(r, c-1)
+		updateCell(r, c+1)
+	}
+	updateCell = func(r, c int) {
+		if r >= 0 && c >= 0 && r < rows && c < cols {
+			cur[r*cols+c]++
+			if cur[r*cols+c] >= 4 {
+				topple(r, c)
+			}
+		}
+	}
+	for i, n := range cur {
+		if n >= 4 {
+			st.Push(Cell{i / cols, i % cols})
+		}
+	}
+	for !st.Empty() {
+		cell := st.Pop()
+		if cur[cell.r*cols+cell.c] >= 4 {
+			topple(cell.r, cell.c)
+		}
+	}
+	return cur
+}
+
+// testBoard is a board to stabilize: piles of grains on an empty board,
+// then fill grains added to every cell.
+type testBoard struct {
+	name       string
+	rows, cols int
+	piles      []pile
+	fill       int
+}
+
+var testBoards = []testBoard{
+	{"empty", 5, 5, nil, 0},
+	{"stable", 4, 4, nil, 3},
+	{"one cell", 1, 1, []pile{{0, 0, 17}}, 0},
+	{"one row", 1, 9, []pile{{0, 4, 40}}, 0},
+	{"one column", 9, 1, []pile{{4, 0, 40}}, 0},
+	{"just unstable", 3, 3, []pile{{1, 1, 4}}, 0},
+	{"all 3s plus one", 5, 5, []pile{{2, 2, 1}}, 3},
+	{"all 4s", 6, 6, nil, 4},
+	{"center", 15, 15, []pile{{7, 7, 300}}, 0},
+	{"corner", 10, 10, []pile{{0, 0, 200}}, 0},
+	{"rectangle", 7, 23, []pile{{3, 11, 250}}, 0},
+	{"tall", 23, 7, []pile{{11, 3, 250}}, 0},
+	{"two piles", 12, 18, []pile{{3, 4, 120}, {8, 13, 90}}, 1},
+	{"overflowing", 4, 5, []pile{{1, 2, 500}}, 2},
+	{"large", 41, 57, []pile{{20, 28, 6000}, {5, 5, 700}}, 0},
+}
+
+// newTestBoard returns the board of tb, with its unstable cells on the
+// stack.
+func newTestBoard(tb testBoard) *Board {
+	b := newBoard(tb.rows, tb.cols)
+	for r := 0; r < tb.rows; r++ {
+		for c := 0; c < tb.cols; c++ {
+			b.AddGrains(r, c, tb.fill)
+		}
+	}
+	for _, p := range tb.piles {
+		b.AddGrains(p.r, p.c, p.n)
+	}
+	return b
+}
+
+func TestComputeSteadyState(t *testing.T) {
+	for _, tb := range testBoards {
+		for _, single := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/single=%v", tb.name, single), func(t *testing.T) {
+				b := newTestBoard(tb)
+				sync := stabilizeSync(b.rows, b.cols, b.cell)
+				recursive := stabilizeRecursive(b.rows, b.cols, b.cell)
+				b.single = single
+				ComputeSteadyState(b)
+				if !slices.Equal(b.cell, sync) {
+					t.Errorf("got\n%v\nsynchronous reference\n%v", b.cell, sync)
+				}
+				if !slices.Equal(b.cell, recursive) {
+					t.Errorf("got\n%v\nrecursive reference\n%v", b.cell, recursive)
+				}
+				if !b.isConverged() {
+					t.Errorf("stack not empty: %v", b.st)
+				}
+			})
+		}
+	}
+}
+
+// TestComputeSteadyStateParallel checks that any number of workers gives
+// the same board as one, including more workers than rows and tiles of a
+// single row.
+func TestComputeSteadyStateParallel(t *testing.T) {
+	for _, tb := range testBoards {
+		want := newTestBoard(tb)
+		ComputeSteadyState(want)
+		for workers := 1; workers <= min(tb.rows+2, 16); workers++ {
+			for _, single := range []bool{false, true} {
+				b := newTestBoard(tb)
+				b.single = single
+				ComputeSteadyStateParallel(b, workers)
+				if !slices.Equal(b.cell, want.cell) {
+					t.Errorf("%s, %d workers, single=%v: got\n%v\nwant\n%v",
+						tb.name, workers, single, b.cell, want.cell)
+				}
+			}
+		}
+	}
+}
+
+// benchPile returns a board of size by size cells with n grains on the
+// center cell.
+func benchPile(size, n int) *Board {
+	b := newBoard(size, size)
+	b.AddGrains(size/2, size/2, n)
+	return b
+}
+
+// BenchmarkComputeSteadyState compares toppling 4 grains at a time from
+// the stack with sweeping the board.
+func BenchmarkComputeSteadyState(b *testing.B) {
+	for _, single := range []bool{true, false} {
+		name := "sweep"
+		if single {
+			name = "single"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				board := benchPile(201, 40000)
+				board.single = single
+				ComputeSteadyState(board)
+			}
+		})
+	}
+}
+
+func BenchmarkComputeSteadyStateParallel(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ComputeSteadyStateParallel(benchPile(201, 40000), workers)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import "sync"
+
+// tile is a band of rows [r0, r1) of a Board, stabilized by a goroutine of
+// its own. Grains it topples over its top and bottom edges are counted in
+// up and down, per column, and handed to the neighbouring tiles between
+// rounds, so that no two goroutines ever write the same cell.
+type tile struct {
+	r0, r1   int
+	up, down []int32
+	st       stack
+
+	// Columns lo[r-r0] to hi[r-r0] of row r may be unstable in the
+	// current sweep, and nlo, nhi in the next; see sweep.
+	lo, hi, nlo, nhi []int
+}
+
+// ComputeSteadyStateParallel stabilizes b like ComputeSteadyState, with the
+// board split into up to workers tiles toppled concurrently. Every round
+// each tile topples until it is stable on its own; then the grains that
+// crossed tile edges are delivered, and rounds go on until none did. The
+// sandpile is abelian, so the result is the same as ComputeSteadyState's
+// for any number of workers. The work is not: a tile stabilizes before
+// the grains its neighbours shed reach it, and then topples many of its
+// cells again, so on a board like a central pile the tiles do about twice
+// as much work in all as ComputeSteadyState; see
+// BenchmarkComputeSteadyStateParallel.
+func ComputeSteadyStateParallel(b *Board, workers int) {
+	if workers > b.rows {
+		workers = b.rows
+	}
+	if workers <= 1 {
+		ComputeSteadyState(b)
+		return
+	}
+	rows := (b.rows + workers - 1) / workers
+	var tiles []*tile
+	for r0 := 0; r0 < b.rows; r0 += rows {
+		r1 := r0 + rows
+		if r1 > b.rows {
+			r1 = b.rows
+		}
+		tiles = append(tiles, &tile{r0: r0, r1: r1,
+			up: make([]int32, b.cols), down: make([]int32, b.cols)})
+	}
+	for !b.st.Empty() {
+		cell := b.st.Pop()
+		tiles[cell.r/rows].st.Push(cell)
+	}
+
+	for {
+		var wg sync.WaitGroup
+		for _, t := range tiles {
+			wg.Add(1)
+			go func(t *tile) {
+				defer wg.Done()
+				t.stabilize(b)
+			}(t)
+		}
+		wg.Wait()
+
+		moved := false
+		for i, t := range tiles {
+			if i > 0 && tiles[i-1].receive(b, t.up, t.r0-1) {
+				moved = true
+			}
+			if i+1 < len(tiles) && tiles[i+1].receive(b, t.down, t.r1) {
+				moved = true
+			}
+		}
+		if !moved {
+			return
+		}
+	}
+}
+
+// stabilize topples the unstable cells of t until there are none left,
+// all the grains a cell can shed at once unless b.single is set. A tile
+// with more grains to shed than it has rows is swept; a few unstable cells,
+// like those a dropped grain makes, are toppled from the stack.
+func (t *tile) stabilize(b *Board) {
+	if !b.single && shedding(b, t.st) >= t.r1-t.r0 {
+		t.sweep(b)
+		return
+	}
+	for !t.st.Empty() {
+		cell := t.st.Pop()
+		i := cell.r*b.cols + cell.c
+		if b.cell[i] < 4 {
+			continue
+		}
+		n := b.cell[i] / 4
+		if b.single {
+			n = 1
+		}
+		b.cell[i] -= 4 * n
+		if b.cell[i] >= 4 {
+			t.st.Push(cell)
+		}
+		t.add(b, cell.r-1, cell.c, n)
+		t.add(b, cell.r+1, cell.c, n)
+		t.add(b, cell.r, cell.c-1, n)
+		t.add(b, cell.r, cell.c+1, n)
+	}
+}
+
+// add drops n grains on ( r, c): on the board if the cell belongs to t, in
+// up or down if it belongs to a neighbouring tile, and nowhere if it is off
+// the board.
+func (t *tile) add(b *Board, r, c int, n int32) {
+	switch {
+	case c < 0 || c >= b.cols:
+	case r < t.r0:
+		if r >= 0 {
+			t.up[c] += n
+		}
+	case r >= t.r1:
+		if r < b.rows {
+			t.down[c] += n
+		}
+	default:
+		i := r*b.cols + c
+		before := b.cell[i]
+		b.cell[i] += n
+		if before < 4 && b.cell[i] >= 4 {
+			t.st.Push(Cell{r, c})
+		}
+	}
+}
+
+// receive adds the grains of in to row r of t, which is one of its edges,
+// and clears in. It reports whether there were any.
+func (t *tile) receive(b *Board, in []int32, r int) bool {
+	moved := false
+	for c, n := range in {
+		if n == 0 {
+			continue
+		}
+		i := r*b.cols + c
+		before := b.cell[i]
+		b.cell[i] += n
+		if before < 4 && b.cell[i] >= 4 {
+			t.st.Push(Cell{r, c})
+		}
+		in[c] = 0
+		moved = true
+	}
+	return moved
+}
+
+// shedding returns the number of topplings the cells of st can make before
+// they get any more grains.
+func shedding(b *Board, st stack) int {
+	n := 0
+	for _, cell := range st {
+		n += int(b.cell[cell.r*b.cols+cell.c] / 4)
+	}
+	return n
+}
+
+// sweep stabilizes t by going over its rows again and again, forward and
+// backward in turn, toppling every unstable cell it meets with all the
+// grains the cell can shed. Unlike the stack, which topples a cell as soon
+// as it reaches 4 grains, a sweep lets grains pile up on a cell from all
+// its neighbours before it is toppled, so a cell topples more grains less
+// often. Only the columns next to the cells the last sweep toppled are
+// swept again. The stack of t is empty afterwards.
+func (t *tile) sweep(b *Board) {
+	rows, cols := t.r1-t.r0, b.cols
+	if len(t.lo) != rows {
+		t.lo, t.hi = make([]int, rows), make([]int, rows)
+		t.nlo, t.nhi = make([]int, rows), make([]int, rows)
+	}
+	lo, hi, nlo, nhi := t.lo, t.hi, t.nlo, t.nhi
+	for i := range nlo {
+		nlo[i], nhi[i] = cols, -1
+	}
+	top, bottom := rows, -1 // rows to sweep next
+	mark := func(i, c int) {
+		if i >= 0 && i < rows {
+			nlo[i] = min(nlo[i], max(c-1, 0))
+			nhi[i] = max(nhi[i], min(c+1, cols-1))
+			top, bottom = min(top, i), max(bottom, i)
+		}
+	}
+	for _, cell := range t.st {
+		mark(cell.r-t.r0, cell.c)
+	}
+	t.st = t.st[:0]
+
+	for step := 1; top <= bottom; step = -step {
+		lo, nlo = nlo, lo
+		hi, nhi = nhi, hi
+		first, last := top, bottom
+		// Toppling row i marks rows i-1 to i+1.
+		for i := max(first-1, 0); i <= min(last+1, rows-1); i++ {
+			nlo[i], nhi[i] = cols, -1
+		}
+		top, bottom = rows, -1
+		if step < 0 {
+			first, last = last, first
+		}
+		for i := first; i != last+step; i += step {
+			if lo[i] > hi[i] {
+				continue
+			}
+			r := t.r0 + i
+			c, end := lo[i], hi[i]
+			if step < 0 {
+				c, end = end, c
+			}
+			for ; c != end+step; c += step {
+				j := r*cols + c
+				v := b.cell[j]
+				if v < 4 {
+					continue
+				}
+				n := v / 4
+				b.cell[j] = v % 4
+				switch {
+				case r > t.r0:
+					b.cell[j-cols] += n
+				case r > 0:
+					t.up[c] += n
+				}
+				switch {
+				case r+1 < t.r1:
+					b.cell[j+cols] += n
+				case r+1 < b.rows:
+					t.down[c] += n
+				}
+				if c > 0 {
+					b.cell[j-1] += n
+				}
+				if c+1 < cols {
+					b.cell[j+1] += n
+				}
+				mark(i-1, c)
+				mark(i, c)
+				mark(i+1, c)
+			}
+		}
+	}
+	t.lo, t.hi, t.nlo, t.nhi = lo, hi, nlo, nhi
+}